@@ -4,15 +4,12 @@ go 1.20
 
 require (
 	github.com/go-logr/zapr v1.2.4
-	github.com/hashicorp/go-retryablehttp v0.7.4
+	go.etcd.io/bbolt v1.3.8
 	go.uber.org/zap v1.26.0
 	golang.org/x/net v0.17.0
 )
 
-require (
-	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
-	golang.org/x/sys v0.13.0 // indirect
-)
+require golang.org/x/sys v0.13.0 // indirect
 
 require (
 	github.com/go-logr/logr v1.2.4
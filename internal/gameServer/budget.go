@@ -0,0 +1,201 @@
+package gameserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+const (
+	MaxFilenameLength = 255
+)
+
+const (
+	ResponseRejected = 254 // sent in place of the normal response when a TCP request is refused
+)
+
+const (
+	RejectFileTooLarge   = 1
+	RejectRoomBudget     = 2
+	RejectServerBudget   = 3
+	RejectBadFilename    = 4
+	RejectTooManyFiles   = 5
+	RejectUnknownRequest = 6
+	RejectDataMismatch   = 7
+	RejectBadSavestate   = 8
+)
+
+// TCPRejection is returned when a TCP request is refused. The reason is sent back to the client.
+type TCPRejection struct {
+	Reason  byte
+	Message string
+}
+
+func (r *TCPRejection) Error() string {
+	return r.Message
+}
+
+// UploadBudget limits the memory held by saves and custom data uploaded over TCP.
+// A single UploadBudget is shared by every room on the server; zero limits are unlimited.
+type UploadBudget struct {
+	MaxFileSize   uint32
+	MaxRoomBytes  int64
+	MaxTotalBytes int64
+	MaxRoomFiles  int
+	used          atomic.Int64
+}
+
+// Used returns the number of bytes currently held by all rooms.
+func (b *UploadBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.used.Load()
+}
+
+func (b *UploadBudget) reserve(size int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if b.MaxTotalBytes > 0 && used+size > b.MaxTotalBytes {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+size) {
+			return true
+		}
+	}
+}
+
+func (b *UploadBudget) release(size int64) {
+	if b == nil {
+		return
+	}
+	b.used.Add(-size)
+}
+
+func validateFilename(filename string) error {
+	if filename == "" || len(filename) > MaxFilenameLength {
+		return &TCPRejection{Reason: RejectBadFilename, Message: "bad filename length"}
+	}
+	if filename == "." || filename == ".." || strings.ContainsAny(filename, `/\:`) {
+		return &TCPRejection{Reason: RejectBadFilename, Message: "filename contains a path"}
+	}
+	for _, r := range filename {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return &TCPRejection{Reason: RejectBadFilename, Message: "filename contains invalid characters"}
+		}
+	}
+	return nil
+}
+
+// uploadKey identifies an upload in the room accounting and data hashes. Custom data slots
+// are named "custom:<slot>", which can not collide with a filename since ':' is rejected.
+func uploadKey(request *TCPRequest) string {
+	if request.CustomID != 0 {
+		return fmt.Sprintf("custom:%d", request.CustomID)
+	}
+	if request.Type == RequestSendSavestate {
+		return savestateKey
+	}
+	return request.Filename
+}
+
+// reserveUpload is called once the size of an upload is known, before any of it is buffered.
+func (g *GameServer) reserveUpload(request *TCPRequest, size uint32) error {
+	if g.Budget != nil && g.Budget.MaxFileSize > 0 && size > g.Budget.MaxFileSize {
+		return &TCPRejection{Reason: RejectFileTooLarge, Message: fmt.Sprintf("upload of %d bytes is larger than %d", size, g.Budget.MaxFileSize)}
+	}
+
+	g.TCPFilesMutex.Lock()
+	defer g.TCPFilesMutex.Unlock()
+	key := uploadKey(request)
+	if _, exists := g.uploadSizes[key]; !exists && g.Budget != nil && g.Budget.MaxRoomFiles > 0 && len(g.uploadSizes) >= g.Budget.MaxRoomFiles {
+		return &TCPRejection{Reason: RejectTooManyFiles, Message: "too many files in room"}
+	}
+	if g.Budget != nil && g.Budget.MaxRoomBytes > 0 && g.uploadBytes+int64(size) > g.Budget.MaxRoomBytes {
+		return &TCPRejection{Reason: RejectRoomBudget, Message: "room upload budget exceeded"}
+	}
+	if !g.Budget.reserve(int64(size)) {
+		return &TCPRejection{Reason: RejectServerBudget, Message: "server upload budget exceeded"}
+	}
+	g.uploadBytes += int64(size)
+	return nil
+}
+
+// cancelUpload returns a reservation that was never stored, for example when the sender disconnected.
+func (g *GameServer) cancelUpload(size uint32) {
+	g.TCPFilesMutex.Lock()
+	defer g.TCPFilesMutex.Unlock()
+	g.uploadBytes -= int64(size)
+	g.Budget.release(int64(size))
+}
+
+// storeUpload keeps a completed upload whose size was reserved, releasing any previous upload with the same name.
+// raw is the uncompressed data, which is what the stored hash is taken of.
+func (g *GameServer) storeUpload(request *TCPRequest, raw []byte) {
+	g.TCPFilesMutex.Lock()
+	defer g.TCPFilesMutex.Unlock()
+	key := uploadKey(request)
+	if old, exists := g.uploadSizes[key]; exists {
+		g.uploadBytes -= old
+		g.Budget.release(old)
+	}
+	g.uploadSizes[key] = int64(len(request.Data))
+	g.uploadHashes[key] = hashData(raw)
+	delete(g.encodedUploads, key)
+	g.compressedUploads[key] = request.Compressed
+	if request.CustomID != 0 {
+		g.CustomData[request.CustomID] = request.Data
+	} else if request.Type == RequestSendSavestate {
+		g.savestate = &Savestate{Count: request.Count, Data: request.Data, Compressed: request.Compressed}
+	} else {
+		g.TCPFiles[request.Filename] = request.Data
+	}
+	g.notifyTCP()
+}
+
+// dropUpload releases a single upload, TCPFilesMutex must be held.
+func (g *GameServer) dropUpload(key string) {
+	if size, exists := g.uploadSizes[key]; exists {
+		g.uploadBytes -= size
+		g.Budget.release(size)
+		delete(g.uploadSizes, key)
+		delete(g.uploadHashes, key)
+		delete(g.compressedUploads, key)
+		delete(g.encodedUploads, key)
+	}
+}
+
+// releaseUploads drops every upload held by the room and returns its bytes to the server budget.
+func (g *GameServer) releaseUploads() {
+	g.TCPFilesMutex.Lock()
+	defer g.TCPFilesMutex.Unlock()
+	g.Budget.release(g.uploadBytes)
+	g.uploadBytes = 0
+	g.uploadSizes = make(map[string]int64)
+	g.uploadHashes = make(map[string]string)
+	g.partialUploads = make(map[string]*partialUpload)
+	g.compressedUploads = make(map[string]bool)
+	g.encodedUploads = nil
+	g.vaultCopies = nil
+	g.TCPFiles = make(map[string][]byte)
+	g.CustomData = make(map[byte][]byte)
+	g.savestate = nil
+}
+
+// UploadBytes returns the number of bytes held by uploads in this room.
+func (g *GameServer) UploadBytes() int64 {
+	g.TCPFilesMutex.Lock()
+	defer g.TCPFilesMutex.Unlock()
+	return g.uploadBytes
+}
+
+func (g *GameServer) sendRejection(conn *net.TCPConn, rejection *TCPRejection) {
+	if _, err := conn.Write([]byte{ResponseRejected, rejection.Reason}); err != nil {
+		g.Logger.Error(err, "could not send rejection", "address", conn.RemoteAddr().String())
+	}
+}
@@ -0,0 +1,197 @@
+package gameserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	MaxChunkSize  = 64 * 1024
+	progressSteps = 10 // progress is reported every 10% of a transfer
+)
+
+const (
+	chunkRetry    = 0
+	chunkAccepted = 1
+)
+
+// TransferProgress is reported while a player sends or receives a chunked transfer.
+type TransferProgress struct {
+	Player   string
+	Key      string // save filename or "custom:<slot>"
+	Received uint32
+	Total    uint32
+	Upload   bool
+}
+
+type partialUpload struct {
+	data  []byte
+	total uint32
+}
+
+// playerByAddress returns the name of the player connecting from addr, or "" if there is none.
+func (g *GameServer) playerByAddress(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	for i, v := range g.Players {
+		if tcpAddr.IP.Equal(net.ParseIP(v.IP)) {
+			return i
+		}
+	}
+	return ""
+}
+
+// reportProgress calls OnTransferProgress each time a transfer crosses a progress step.
+func (g *GameServer) reportProgress(conn *net.TCPConn, key string, from uint32, to uint32, total uint32, upload bool) {
+	if g.OnTransferProgress == nil {
+		return
+	}
+	if total != 0 && uint64(from)*progressSteps/uint64(total) == uint64(to)*progressSteps/uint64(total) && to != total {
+		return
+	}
+	g.OnTransferProgress(TransferProgress{
+		Player:   g.playerByAddress(conn.RemoteAddr()),
+		Key:      key,
+		Received: to,
+		Total:    total,
+		Upload:   upload,
+	})
+}
+
+func (g *GameServer) sendChunkResponse(conn *net.TCPConn, status byte, offset uint32) {
+	response := make([]byte, 5) //nolint:gomnd,mnd
+	response[0] = status
+	binary.BigEndian.PutUint32(response[1:], offset)
+	if _, err := conn.Write(response); err != nil {
+		g.Logger.Error(err, "could not send chunk response", "address", conn.RemoteAddr().String())
+	}
+}
+
+// tcpReceiveChunk appends one chunk of a save or custom data upload. The client is told the
+// offset it should continue from, which is unchanged if the chunk was out of order or corrupted.
+func (g *GameServer) tcpReceiveChunk(request *TCPRequest, conn *net.TCPConn) {
+	key := uploadKey(request)
+	chunkEnd := uint64(request.Offset) + uint64(len(request.Data))
+
+	g.TCPFilesMutex.Lock()
+	partial, ok := g.partialUploads[key]
+	if ok && request.Offset == 0 && partial.total != request.Total { // the client started over with different data
+		delete(g.partialUploads, key)
+		g.uploadBytes -= int64(partial.total)
+		g.Budget.release(int64(partial.total))
+		ok = false
+	}
+	g.TCPFilesMutex.Unlock()
+
+	if !ok {
+		if request.Offset != 0 {
+			g.sendChunkResponse(conn, chunkRetry, 0)
+			return
+		}
+		if err := g.reserveUpload(request, request.Total); err != nil {
+			g.Logger.Error(err, "rejected chunked upload", "key", key, "total", request.Total, "address", conn.RemoteAddr().String())
+			var rejection *TCPRejection
+			if errors.As(err, &rejection) {
+				g.sendRejection(conn, rejection)
+			}
+			return
+		}
+		partial = &partialUpload{data: make([]byte, 0, request.Total), total: request.Total}
+		g.TCPFilesMutex.Lock()
+		g.partialUploads[key] = partial
+		g.TCPFilesMutex.Unlock()
+	}
+
+	g.TCPFilesMutex.Lock()
+	received := uint32(len(partial.data))
+	valid := request.Total == partial.total && request.Offset == received && chunkEnd <= uint64(partial.total) && crc32.ChecksumIEEE(request.Data) == request.Checksum
+	if valid {
+		partial.data = append(partial.data, request.Data...)
+	}
+	complete := valid && uint32(len(partial.data)) == partial.total
+	if complete {
+		delete(g.partialUploads, key) // the reservation carries over to the stored upload
+	}
+	g.TCPFilesMutex.Unlock()
+
+	if !valid {
+		g.Logger.Info("rejected chunk", "key", key, "offset", request.Offset, "expected", received, "address", conn.RemoteAddr().String())
+		g.sendChunkResponse(conn, chunkRetry, received)
+		return
+	}
+	g.sendChunkResponse(conn, chunkAccepted, uint32(chunkEnd))
+	g.reportProgress(conn, key, received, uint32(chunkEnd), partial.total, true)
+
+	if complete {
+		upload := &TCPRequest{Type: RequestSendSave, Filename: request.Filename, CustomID: request.CustomID, Data: partial.data, Compressed: request.Compressed}
+		if request.CustomID != 0 {
+			upload.Type = request.CustomID
+		}
+		g.completeUpload(upload, conn)
+	}
+}
+
+// tcpSendTransferOffset tells a client where to resume an upload, which is the full size if it already completed.
+func (g *GameServer) tcpSendTransferOffset(request *TCPRequest, conn *net.TCPConn) {
+	key := uploadKey(request)
+	var offset uint32
+	g.TCPFilesMutex.Lock()
+	if partial, ok := g.partialUploads[key]; ok {
+		offset = uint32(len(partial.data))
+	} else if size, ok := g.uploadSizes[key]; ok {
+		offset = uint32(size)
+	}
+	g.TCPFilesMutex.Unlock()
+
+	response := make([]byte, 4) //nolint:gomnd,mnd
+	binary.BigEndian.PutUint32(response, offset)
+	if _, err := conn.Write(response); err != nil {
+		g.Logger.Error(err, "could not send transfer offset", "address", conn.RemoteAddr().String())
+	}
+}
+
+// tcpSendChunk waits for a save or custom data upload to complete and sends the chunk starting at
+// request.Offset as total (4 bytes), offset (4 bytes), length (4 bytes), CRC-32 (4 bytes) and data.
+func (g *GameServer) tcpSendChunk(request *TCPRequest, conn *net.TCPConn) {
+	stored, storedCompressed, ready := g.waitForData(request.Filename, request.CustomID)
+	if !ready {
+		g.Logger.Info("TCP connection timed out in tcpSendChunk")
+		return
+	}
+	data, err := g.encodeUpload(uploadKey(request), stored, storedCompressed, request.Compressed)
+	if err != nil {
+		g.Logger.Error(err, "could not encode chunked payload", "address", conn.RemoteAddr().String())
+		return
+	}
+
+	total := uint32(len(data))
+	offset := request.Offset
+	if offset > total {
+		offset = total
+	}
+	length := total - offset
+	if length > MaxChunkSize {
+		length = MaxChunkSize
+	}
+	if request.Length != 0 && length > request.Length {
+		length = request.Length
+	}
+	chunk := data[offset : offset+length]
+
+	header := make([]byte, chunkHeaderSize)
+	binary.BigEndian.PutUint32(header, total)
+	binary.BigEndian.PutUint32(header[4:], offset)
+	binary.BigEndian.PutUint32(header[8:], length)
+	binary.BigEndian.PutUint32(header[12:], crc32.ChecksumIEEE(chunk))
+	if _, err := conn.Write(append(header, chunk...)); err != nil {
+		g.Logger.Error(err, "could not write chunk", "address", conn.RemoteAddr().String())
+		return
+	}
+	g.reportProgress(conn, uploadKey(request), offset, offset+length, total, false)
+}
@@ -22,9 +22,12 @@ type GameData struct {
 }
 
 type Client struct {
-    Socket *websocket.Conn
-    IP     string
-    Number int
+    Socket     *websocket.Conn
+    DataHashes map[string]string // reported by the client, keyed like the room uploads
+    IP         string
+    Number     int
+    SwapWith   string // the player this one asked to trade slots with in the lobby
+    Ready      bool   // set by the player in the lobby, for the host's start rules
 }
 
 type Registration struct {
@@ -50,6 +53,7 @@ const (
     KeyInfoServerGratuitous = 3
     CP0Info                 = 4
     StatusDesync            = 1
+    StatusResyncRequested   = 0x20 // a reconnecting player is waiting for a RequestSendSavestate
     DisconnectTimeoutS      = 30
     NoRegID                 = 255
     InputDataMax     uint32 = 5000
@@ -58,8 +62,4 @@ const (
 
 func uintLarger(v uint32, w uint32) bool {
     return (w - v) > (math.MaxUint32 / 2) //nolint:gomnd
-}
-
-type Lobby interface {
-	DestroyLobby(gameName string)
 }
\ No newline at end of file
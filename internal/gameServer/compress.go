@@ -0,0 +1,125 @@
+package gameserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	CompressionGzip      = 0x1
+	supportedCompression = CompressionGzip
+	maxDecompressedSize  = 64 * 1024 * 1024 // used when the upload budget has no per-file limit
+)
+
+// tcpNegotiate answers RequestNegotiate with the compression flags both sides support.
+// Once negotiated, saves and custom data sent on the connection in either direction are gzip
+// streams, and whole payloads sent by the server are prefixed with their size (4 bytes).
+func (g *GameServer) tcpNegotiate(flags byte, conn *net.TCPConn) byte {
+	accepted := flags & supportedCompression
+	if _, err := conn.Write([]byte{accepted}); err != nil {
+		g.Logger.Error(err, "could not send negotiation response", "address", conn.RemoteAddr().String())
+	}
+	g.Logger.Info("negotiated TCP options", "requested", flags, "accepted", accepted, "address", conn.RemoteAddr().String())
+	return accepted
+}
+
+func compressPayload(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("could not compress payload: %s", err.Error())
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("could not compress payload: %s", err.Error())
+	}
+	return compressed.Bytes(), nil
+}
+
+// decompressPayload expands a gzip upload, refusing anything that grows past the per-file limit.
+func (g *GameServer) decompressPayload(data []byte) ([]byte, error) {
+	limit := int64(maxDecompressedSize)
+	if g.Budget != nil && g.Budget.MaxFileSize > 0 {
+		limit = int64(g.Budget.MaxFileSize)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress payload: %s", err.Error())
+	}
+	defer reader.Close()
+	raw, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress payload: %s", err.Error())
+	}
+	if int64(len(raw)) > limit {
+		return nil, fmt.Errorf("decompressed payload is larger than %d", limit)
+	}
+	return raw, nil
+}
+
+// encodePayload converts stored data into what a connection expects, compressing for
+// connections that negotiated compression and decompressing for legacy ones.
+func (g *GameServer) encodePayload(data []byte, storedCompressed bool, wantCompressed bool) ([]byte, error) {
+	switch {
+	case storedCompressed == wantCompressed:
+		return data, nil
+	case wantCompressed:
+		return compressPayload(data)
+	default:
+		return g.decompressPayload(data)
+	}
+}
+
+// encodedUpload is a stored upload converted for connections that use the other encoding.
+type encodedUpload struct {
+	source  []byte
+	payload []byte
+}
+
+func sameData(a []byte, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// encodeUpload is encodePayload for the data stored under key. The conversion is done once and
+// kept until the data changes, so sending a large upload in many chunks does not redo it each time.
+func (g *GameServer) encodeUpload(key string, data []byte, storedCompressed bool, wantCompressed bool) ([]byte, error) {
+	if storedCompressed == wantCompressed {
+		return data, nil
+	}
+	g.TCPFilesMutex.Lock()
+	cached, ok := g.encodedUploads[key]
+	g.TCPFilesMutex.Unlock()
+	if ok && sameData(cached.source, data) {
+		return cached.payload, nil
+	}
+
+	payload, err := g.encodePayload(data, storedCompressed, wantCompressed)
+	if err != nil {
+		return nil, err
+	}
+	g.TCPFilesMutex.Lock()
+	if g.encodedUploads == nil {
+		g.encodedUploads = make(map[string]*encodedUpload)
+	}
+	g.encodedUploads[key] = &encodedUpload{source: data, payload: payload}
+	g.TCPFilesMutex.Unlock()
+	return payload, nil
+}
+
+// writePayload sends a whole save or custom data upload, stored under key, to conn.
+func (g *GameServer) writePayload(conn *net.TCPConn, key string, data []byte, storedCompressed bool, wantCompressed bool) error {
+	payload, err := g.encodeUpload(key, data, storedCompressed, wantCompressed)
+	if err != nil {
+		return err
+	}
+	if wantCompressed {
+		header := make([]byte, sizeFieldSize)
+		binary.BigEndian.PutUint32(header, uint32(len(payload)))
+		payload = append(header, payload...)
+	}
+	_, err = conn.Write(payload)
+	return err //nolint:wrapcheck
+}
@@ -0,0 +1,102 @@
+package gameserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DataMismatch names a player whose loaded saves or custom data differ from the host's.
+type DataMismatch struct {
+	Player string
+	Keys   []string
+}
+
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// SetDataHashes records the SHA-256 hashes a player reported for the data they loaded,
+// keyed by save filename or "custom:<slot>". It returns false if the player is not in the room.
+func (g *GameServer) SetDataHashes(player string, hashes map[string]string) bool {
+	normalized := make(map[string]string, len(hashes))
+	for k, v := range hashes {
+		normalized[k] = strings.ToLower(v)
+	}
+
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	client, ok := g.Players[player]
+	if !ok {
+		return false
+	}
+	client.DataHashes = normalized
+	g.Players[player] = client
+	return true
+}
+
+// MissingDataHashes returns the players, in name order, that have not reported their data hashes.
+func (g *GameServer) MissingDataHashes() []string {
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	var missing []string
+	for name, client := range g.Players {
+		if client.DataHashes == nil {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// CheckDataHashes compares the hashes reported by each player with the ones reported by the host.
+// Players that did not report hashes are skipped, since older clients do not send them. Rooms with
+// StrictDataCheck must use MissingDataHashes to refuse starting without them.
+func (g *GameServer) CheckDataHashes() []DataMismatch {
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	host, ok := g.Players[g.PlayerName]
+	if !ok || host.DataHashes == nil {
+		return nil
+	}
+
+	var mismatches []DataMismatch
+	for name, client := range g.Players {
+		if name == g.PlayerName || client.DataHashes == nil {
+			continue
+		}
+		var keys []string
+		for k, v := range host.DataHashes {
+			if client.DataHashes[k] != v {
+				keys = append(keys, k)
+			}
+		}
+		for k := range client.DataHashes {
+			if _, ok := host.DataHashes[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			mismatches = append(mismatches, DataMismatch{Player: name, Keys: keys})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Player < mismatches[j].Player })
+	return mismatches
+}
+
+// checkUploadHash compares an upload, raw being its uncompressed data, with what the host
+// reported loading before the game started.
+func (g *GameServer) checkUploadHash(request *TCPRequest, raw []byte) error {
+	key := uploadKey(request)
+	g.PlayersMutex.Lock()
+	reported, ok := g.Players[g.PlayerName].DataHashes[key]
+	g.PlayersMutex.Unlock()
+	if uploaded := hashData(raw); ok && reported != uploaded {
+		return &TCPRejection{Reason: RejectDataMismatch, Message: fmt.Sprintf("upload %s hashes to %s, the host reported %s", key, uploaded, reported)}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package gameserver
+
+import (
+	"fmt"
+	"time"
+)
+
+// RoomState is a step in a room's lifecycle. Rooms only move forward:
+// Created → Lobby → Starting → Running → Ended → Destroyed, and can end from any state before Ended.
+type RoomState int
+
+const (
+	StateCreated   RoomState = iota // network servers are up, the room is not listed yet
+	StateLobby                      // listed in the lobby and accepting players
+	StateStarting                   // the game was started, players are exchanging saves and registering
+	StateRunning                    // every player registered and inputs are flowing
+	StateEnded                      // network servers are closed
+	StateDestroyed                  // removed from the lobby
+)
+
+const (
+	PacketTimeout = 60 * time.Second // a running room with no input packets for this long is closed
+)
+
+var roomStateNames = [...]string{"created", "lobby", "starting", "running", "ended", "destroyed"}
+
+var roomTransitions = map[RoomState][]RoomState{
+	StateCreated:  {StateLobby, StateEnded},
+	StateLobby:    {StateStarting, StateEnded},
+	StateStarting: {StateRunning, StateEnded},
+	StateRunning:  {StateEnded},
+	StateEnded:    {StateDestroyed},
+}
+
+// StateHook is called after a room moves from one state to another.
+type StateHook func(g *GameServer, from RoomState, to RoomState)
+
+func (s RoomState) String() string {
+	if s < 0 || int(s) >= len(roomStateNames) {
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+	return roomStateNames[s]
+}
+
+func (s RoomState) canTransition(to RoomState) bool {
+	for _, v := range roomTransitions[s] {
+		if v == to {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the room's current lifecycle state.
+func (g *GameServer) State() RoomState {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+	return g.state
+}
+
+// StateTime returns when the room entered state, or the zero time if it never did.
+func (g *GameServer) StateTime(state RoomState) time.Time {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+	if state < 0 || int(state) >= len(g.stateTimes) {
+		return time.Time{}
+	}
+	return g.stateTimes[state]
+}
+
+// InGame reports whether the game was started and has not ended yet.
+func (g *GameServer) InGame() bool {
+	state := g.State()
+	return state == StateStarting || state == StateRunning
+}
+
+// OnStateChange registers a hook that is called, in order of registration, after every transition.
+func (g *GameServer) OnStateChange(hook StateHook) {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+	g.stateHooks = append(g.stateHooks, hook)
+}
+
+// Ended returns a channel that is closed when the room reaches StateEnded.
+func (g *GameServer) Ended() <-chan struct{} {
+	g.stateMutex.Lock()
+	defer g.stateMutex.Unlock()
+	return g.endedChannel()
+}
+
+// endedChannel must be called with stateMutex held.
+func (g *GameServer) endedChannel() chan struct{} {
+	if g.ended == nil {
+		g.ended = make(chan struct{})
+	}
+	return g.ended
+}
+
+// Transition moves the room to state to, or returns an error if that is not the next step from
+// the current state. The room's own work for the new state starts before the hooks are called.
+func (g *GameServer) Transition(to RoomState) error {
+	now := time.Now()
+	g.stateMutex.Lock()
+	from := g.state
+	if !from.canTransition(to) {
+		g.stateMutex.Unlock()
+		return fmt.Errorf("invalid room transition from %s to %s", from, to)
+	}
+	g.state = to
+	g.stateTimes[to] = now
+	switch to {
+	case StateStarting:
+		g.StartTime = now
+	case StateEnded:
+		close(g.endedChannel())
+	}
+	hooks := append([]StateHook(nil), g.stateHooks...)
+	g.stateMutex.Unlock()
+
+	g.Logger.Info("room state changed", "from", from.String(), "to", to.String())
+	if to == StateStarting {
+		go g.ManageBuffer()
+		go g.ManagePlayers()
+	}
+	for _, hook := range hooks {
+		hook(g, from, to)
+	}
+	return nil
+}
+
+// end moves the room to StateEnded unless it already got there.
+func (g *GameServer) end() {
+	if err := g.Transition(StateEnded); err != nil && g.State() < StateEnded {
+		g.Logger.Error(err, "could not end room")
+	}
+}
+
+// checkAllRegistered moves a starting room to StateRunning once every player has registered.
+func (g *GameServer) checkAllRegistered() {
+	if g.State() != StateStarting {
+		return
+	}
+	g.PlayersMutex.Lock()
+	numPlayers := len(g.Players)
+	g.PlayersMutex.Unlock()
+	g.RegistrationsMutex.Lock()
+	numRegistered := len(g.Registrations)
+	if numPlayers == 0 || numRegistered < numPlayers {
+		g.RegistrationsMutex.Unlock()
+		return
+	}
+	g.runningSlots = 0
+	for slot := range g.Registrations {
+		g.runningSlots |= 0x1 << slot
+	}
+	g.RegistrationsMutex.Unlock()
+	if err := g.Transition(StateRunning); err != nil {
+		g.Logger.Error(err, "could not mark room as running")
+	}
+}
@@ -0,0 +1,79 @@
+package gameserver
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Controller paks, as the emulator reports them in RequestRegisterPlayer.
+const (
+	PakNone     = 1
+	PakMemory   = 2
+	PakRumble   = 3
+	PakTransfer = 4
+)
+
+// PakPolicy is the host's choice of which slots may use which controller pak. A pak a slot is not
+// allowed is replaced by PakNone when the player registers, so every player sees the same paks in
+// the registration data.
+type PakPolicy struct {
+	Mempak    []int `json:"mempak"`   // slots that may use a mempak
+	Rumble    []int `json:"rumble"`   // slots that may use a rumble pak
+	Transfer  []int `json:"transfer"` // slots that may use a transfer pak
+	ForceNone bool  `json:"force_none,omitempty"`
+}
+
+// DefaultPakPolicy only lets P1 use a mempak, so saves have one owner. Other paks are allowed everywhere.
+func DefaultPakPolicy() PakPolicy {
+	return PakPolicy{
+		Mempak:   []int{0},
+		Rumble:   []int{0, 1, 2, 3},
+		Transfer: []int{0, 1, 2, 3},
+	}
+}
+
+// UnmarshalJSON starts from DefaultPakPolicy, so a host only has to send the paks they want to change.
+func (p *PakPolicy) UnmarshalJSON(data []byte) error {
+	type Alias PakPolicy
+	policy := Alias(DefaultPakPolicy())
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return err
+	}
+	*p = PakPolicy(policy)
+	return nil
+}
+
+func (p *PakPolicy) Validate() error {
+	for _, slots := range [][]int{p.Mempak, p.Rumble, p.Transfer} {
+		for _, slot := range slots {
+			if slot < 0 || slot > 3 { //nolint:gomnd,mnd
+				return fmt.Errorf("invalid pak slot %d", slot)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed returns the pak the player in slot gets when they ask for plugin.
+func (p *PakPolicy) Allowed(slot byte, plugin byte) byte {
+	var slots []int
+	switch plugin {
+	case PakMemory:
+		slots = p.Mempak
+	case PakRumble:
+		slots = p.Rumble
+	case PakTransfer:
+		slots = p.Transfer
+	default:
+		return plugin
+	}
+	if p.ForceNone {
+		return PakNone
+	}
+	for _, v := range slots {
+		if v == int(slot) {
+			return plugin
+		}
+	}
+	return PakNone
+}
@@ -0,0 +1,151 @@
+package gameserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	savestateKey = "state:resync" // uploadKey of the savestate, ':' can not appear in a filename
+)
+
+// Savestate is a snapshot uploaded by a healthy player so that a reconnecting player can resume.
+// Count is the input count the snapshot was taken at, inputs resume from there.
+type Savestate struct {
+	Data       []byte
+	Count      uint32
+	Compressed bool // stored as the gzip stream the sender uploaded
+}
+
+// CanReconnect reports whether number is a player slot of the running game that a client may take over again.
+// That is only the case for a slot that was registered when the game started running, once its player
+// dropped: their registration is gone or they are marked as disconnected.
+func (g *GameServer) CanReconnect(number int) bool {
+	if g.State() != StateRunning || number < 0 || number >= 4 { //nolint:gomnd,mnd
+		return false
+	}
+	slot := byte(number)
+	g.RegistrationsMutex.Lock()
+	_, registered := g.Registrations[slot]
+	played := g.runningSlots&(0x1<<slot) != 0
+	g.RegistrationsMutex.Unlock()
+	if !played {
+		return false
+	}
+	g.GameDataMutex.Lock()
+	disconnected := g.GameData.Status&(0x1<<(slot+1)) != 0 //nolint:gomnd,mnd
+	g.GameDataMutex.Unlock()
+	return !registered || disconnected
+}
+
+// checkSavestateCount refuses a savestate the game can not resume from: one taken ahead of the
+// lead player, or so far behind that the inputs since then are no longer kept.
+func (g *GameServer) checkSavestateCount(count uint32) error {
+	g.GameDataMutex.Lock()
+	leadCount := g.GameData.LeadCount
+	g.GameDataMutex.Unlock()
+	if uintLarger(count, leadCount) || leadCount-count >= InputDataMax {
+		return &TCPRejection{Reason: RejectBadSavestate, Message: fmt.Sprintf("savestate at count %d does not fit lead count %d", count, leadCount)}
+	}
+	return nil
+}
+
+// BeginReconnect frees the slot of a player that is rejoining a running game and asks the
+// remaining players for a savestate. The client then registers again with a new regID and
+// fetches the savestate with RequestReceiveSavestate.
+func (g *GameServer) BeginReconnect(number int) {
+	slot := byte(number)
+
+	g.GameDataMutex.Lock() // PlayerAlive and Status can be modified by processUDP in a different thread
+	g.GameData.PlayerAlive[slot] = false
+	g.GameData.Status |= (0x1 << (slot + 1)) | StatusResyncRequested //nolint:gomnd,mnd
+	g.recordDisconnect(slot, DisconnectReconnect)
+	g.GameDataMutex.Unlock()
+
+	g.RegistrationsMutex.Lock() // Registrations can be modified by processTCP
+	delete(g.Registrations, slot)
+	g.RegistrationsMutex.Unlock()
+
+	g.TCPFilesMutex.Lock()
+	g.resyncSlots |= 0x1 << slot
+	g.dropUpload(savestateKey) // an older savestate is of no use, the game has moved on
+	g.savestate = nil
+	g.TCPFilesMutex.Unlock()
+
+	g.Logger.Info("player reconnecting, requesting savestate", "player", slot)
+	g.notifyTCP()
+}
+
+// finishReconnect puts a resynced player back into the game.
+func (g *GameServer) finishReconnect(slot byte, count uint32) {
+	g.TCPFilesMutex.Lock()
+	g.resyncSlots &^= 0x1 << slot
+	if g.resyncSlots == 0 {
+		g.dropUpload(savestateKey)
+		g.savestate = nil
+	}
+	g.TCPFilesMutex.Unlock()
+
+	g.GameDataMutex.Lock() // PlayerAlive and Status can be modified by processUDP in a different thread
+	g.GameData.PlayerAlive[slot] = true
+	g.GameData.Status &^= 0x1 << (slot + 1) //nolint:gomnd,mnd
+	// back in the game, so an earlier drop did not end their session
+	g.disconnects[slot] = ""
+	g.GameDataMutex.Unlock()
+
+	g.Logger.Info("player reconnected", "player", slot, "count", count)
+}
+
+// tcpSendSavestate waits for a savestate and sends it to a reconnecting player as
+// count (4 bytes), size (4 bytes) and the savestate itself, compressed if the connection negotiated it.
+func (g *GameServer) tcpSendSavestate(regID uint32, compressed bool, conn *net.TCPConn) {
+	g.RegistrationsMutex.Lock()
+	slot, err := g.getPlayerNumberByID(regID)
+	g.RegistrationsMutex.Unlock()
+	if err != nil {
+		g.Logger.Error(err, "savestate requested by unregistered player", "regID", regID, "address", conn.RemoteAddr().String())
+		return
+	}
+	g.TCPFilesMutex.Lock()
+	resyncing := g.resyncSlots&(0x1<<slot) != 0
+	g.TCPFilesMutex.Unlock()
+	if !resyncing {
+		g.Logger.Error(fmt.Errorf("not reconnecting"), "savestate requested by player that is not reconnecting", "player", slot, "address", conn.RemoteAddr().String())
+		return
+	}
+
+	var savestate *Savestate
+	ready := g.waitTCP(func() bool {
+		g.TCPFilesMutex.Lock()
+		savestate = g.savestate
+		g.TCPFilesMutex.Unlock()
+		return savestate != nil
+	})
+	if !ready {
+		g.Logger.Info("TCP connection timed out in tcpSendSavestate")
+		return
+	}
+
+	payload, err := g.encodeUpload(savestateKey, savestate.Data, savestate.Compressed, compressed)
+	if err != nil {
+		g.Logger.Error(err, "could not encode savestate", "address", conn.RemoteAddr().String())
+		return
+	}
+	// the size is sent on every connection, on compressed ones this is the framing writePayload uses
+	header := make([]byte, countFieldSize+sizeFieldSize)
+	binary.BigEndian.PutUint32(header, savestate.Count)
+	binary.BigEndian.PutUint32(header[countFieldSize:], uint32(len(payload)))
+	if _, err := conn.Write(append(header, payload...)); err != nil {
+		g.Logger.Error(err, "could not write savestate", "address", conn.RemoteAddr().String())
+		return
+	}
+	g.finishReconnect(slot, savestate.Count)
+}
+
+// clearResyncRequest is called when a savestate arrives so the other players stop offering one.
+func (g *GameServer) clearResyncRequest() {
+	g.GameDataMutex.Lock()
+	g.GameData.Status &^= StatusResyncRequested
+	g.GameDataMutex.Unlock()
+}
@@ -0,0 +1,79 @@
+package gameserver
+
+const (
+	FeatureRedundantInputs = "redundant_inputs" // room Features key, clients that understand repeated inputs set it to "true"
+	RedundancyMin          = 1
+	RedundancyMax          = 10
+	lossSmoothing          = 0.1
+)
+
+// inputRedundancy tracks, for each receiving player, which inputs of every player it has
+// confirmed and how lossy its link looks. KeyInfoServerGratuitous packets then repeat the
+// recent inputs that were not confirmed yet, so a lost packet does not cost a round trip.
+// It is only touched from processUDP, which handleInput runs under inputMutex for both transports.
+type inputRedundancy struct {
+	acked  [4][4]uint32 // [receiver][player] count the receiver asked for last, everything before it arrived
+	sent   [4][4]uint32 // [receiver][player] count after the last input pushed to the receiver
+	loss   [4]float64   // smoothed fraction of requests for inputs that had already been pushed
+	window [4]uint32
+}
+
+func newInputRedundancy() *inputRedundancy {
+	r := &inputRedundancy{}
+	for i := range r.window {
+		r.window[i] = RedundancyMin
+	}
+	return r
+}
+
+func (g *GameServer) redundantInputs() bool {
+	v := g.Features[FeatureRedundantInputs]
+	return v == "true" || v == "1"
+}
+
+// redundantStart returns the count a gratuitous packet for player to receiver should start at,
+// going back at most the receiver's window to inputs it has not confirmed.
+func (g *GameServer) redundantStart(receiver int, player byte, count uint32) uint32 {
+	r := g.redundancy
+	acked := r.acked[receiver][player]
+	start := count - r.window[receiver]
+	if !uintLarger(count, acked) {
+		start = count // nothing unconfirmed before count
+	} else if uintLarger(acked, start) {
+		start = acked
+	}
+	for start != count { // sendUDPInput stops at the first count without input
+		if _, ok := g.GameData.Inputs[player][start]; ok {
+			break
+		}
+		start++
+	}
+	return start
+}
+
+// inputPushed records that inputs up to count were pushed to receiver.
+func (g *GameServer) inputPushed(receiver int, player byte, count uint32) {
+	if _, ok := g.GameData.Inputs[player][count]; ok {
+		g.redundancy.sent[receiver][player] = count + 1
+	}
+}
+
+// inputRequested records a PlayerInputRequest, which confirms every input before count and
+// counts as a loss if count had already been pushed. The receiver's window follows its loss.
+func (g *GameServer) inputRequested(receiver byte, player byte, count uint32) {
+	r := g.redundancy
+	if uintLarger(count, r.acked[receiver][player]) {
+		r.acked[receiver][player] = count
+	}
+
+	lost := 0.0
+	if uintLarger(r.sent[receiver][player], count) {
+		lost = 1.0
+	}
+	r.loss[receiver] += (lost - r.loss[receiver]) * lossSmoothing
+	window := RedundancyMin + uint32(r.loss[receiver]*RedundancyMax*2) //nolint:gomnd,mnd
+	if window > RedundancyMax {
+		window = RedundancyMax
+	}
+	r.window[receiver] = window
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/go-logr/logr"
+	"golang.org/x/net/websocket"
 )
 
 type GameServer struct {
@@ -19,9 +20,36 @@ type GameServer struct {
 	RegistrationsMutex sync.Mutex
 	TCPFiles           map[string][]byte
 	CustomData         map[byte][]byte
+	TCPFilesMutex      sync.Mutex
+	Budget             *UploadBudget
+	Vault              *SaveVault
+	VaultGroup         string
+	VaultSaves         bool // the host does not upload saves, every player gets the vault copy
+	StrictDataCheck    bool
+	uploadSizes        map[string]int64
+	uploadHashes       map[string]string
+	encodedUploads     map[string]*encodedUpload
+	vaultCopies        map[string][]byte
+	uploadBytes        int64
+	tcpNotify          chan struct{}
+	tcpNotifyMutex     sync.Mutex
+	savestate          *Savestate
+	resyncSlots        byte
+	runningSlots       byte // the slots registered when the game started running, guarded by RegistrationsMutex
+	partialUploads     map[string]*partialUpload
+	compressedUploads  map[string]bool
+	redundancy         *inputRedundancy
+	inputMutex         sync.Mutex
+	tunnels            map[string]*websocket.Conn
+	tunnelsMutex       sync.Mutex
+	OnTransferProgress func(progress TransferProgress)
+	OnDesync           func(viCount uint32)
 	Logger             logr.Logger
 	GameName           string
 	Password           string
+	BannedPlayers      map[string]string // name to IP, kept out of the room by the host
+	Locked             bool              // the host closed the room to new players
+	PakPolicy          PakPolicy
 	ClientSha          string
 	MD5                string
 	Emulator           string
@@ -30,14 +58,21 @@ type GameServer struct {
 	GameDataMutex      sync.Mutex
 	Port               int
 	HasSettings        bool
-	Running            bool
 	Features           map[string]string
 	PlayerName         string
+	Region             string
 	LastActivity       time.Time
 	LastPacketReceived time.Time
 	CreationTime       time.Time
-	Lobby 			   Lobby
- }
+	state              RoomState
+	stateTimes         [StateDestroyed + 1]time.Time
+	stateHooks         []StateHook
+	stateMutex         sync.Mutex
+	ended              chan struct{}
+	disconnects        [4]string
+	desyncVI           uint32
+	samples            [4]connectionSamples
+}
 
 func (g *GameServer) CreateNetworkServers(basePort int, maxGames int, roomName string, gameName string, playerName string, logger logr.Logger) int {
 	g.Logger = logger.WithValues("game", gameName, "room", roomName, "player", playerName)
@@ -52,6 +87,8 @@ func (g *GameServer) CreateNetworkServers(basePort int, maxGames int, roomName s
 		}
 		return 0
 	}
+	g.CreationTime = time.Now()
+	g.stateTimes[StateCreated] = g.CreationTime
 	g.LastActivity = time.Now()
 	g.LastPacketReceived = time.Now() // Initialize LastPacketReceived
 	go g.MonitorActivity()            // Start monitoring activity
@@ -75,11 +112,13 @@ func (g *GameServer) CloseServers() {
 		}
 		g.TCPListener = nil // Ensure the TCPListener is set to nil after closing
 	}
-	g.Running = false // Set Running flag to false when closing servers
-
-	if g.Lobby != nil {
-		g.Lobby.DestroyLobby(g.GameName) // Call the method to destroy the lobby
+	g.tunnelsMutex.Lock()
+	for _, tunnel := range g.tunnels {
+		tunnel.Close()
 	}
+	g.tunnelsMutex.Unlock()
+	g.releaseUploads()
+	g.end()
 }
 
 func (g *GameServer) isConnClosed(err error) bool {
@@ -90,11 +129,17 @@ func (g *GameServer) isConnClosed(err error) bool {
 }
 
 func (g *GameServer) ManageBuffer() {
+	ticker := time.NewTicker(time.Second * 5) //nolint:gomnd
+	defer ticker.Stop()
+	ended := g.Ended()
 	for {
-		if !g.Running {
+		select {
+		case <-ended:
 			g.Logger.Info("done managing buffers")
 			return
+		case <-ticker.C:
 		}
+		g.sampleConnections()
 		// Adjust the buffer size for the lead player(s)
 		for i := 0; i < 4; i++ {
 			if g.GameData.BufferHealth[i] != -1 && g.GameData.CountLag[i] == 0 {
@@ -107,13 +152,19 @@ func (g *GameServer) ManageBuffer() {
 				}
 			}
 		}
-		time.Sleep(time.Second * 5) //nolint:gomnd
 	}
 }
 
 func (g *GameServer) ManagePlayers() {
-	time.Sleep(time.Second * DisconnectTimeoutS)
+	ticker := time.NewTicker(time.Second * DisconnectTimeoutS)
+	defer ticker.Stop()
+	ended := g.Ended()
 	for {
+		select {
+		case <-ended:
+			return
+		case <-ticker.C:
+		}
 		playersActive := false // used to check if anyone is still around
 		var i byte
 
@@ -127,10 +178,12 @@ func (g *GameServer) ManagePlayers() {
 				} else {
 					g.Logger.Info("play disconnected UDP", "player", i, "regID", g.Registrations[i].RegID, "address", g.GameData.PlayerAddresses[i])
 					g.GameData.Status |= (0x1 << (i + 1)) //nolint:gomnd,mnd
+					g.recordDisconnect(i, DisconnectUDPTimeout)
 
 					g.RegistrationsMutex.Lock() // Registrations can be modified by processTCP
 					delete(g.Registrations, i)
 					g.RegistrationsMutex.Unlock()
+					g.notifyTCP()
 				}
 			}
 			g.GameData.PlayerAlive[i] = false
@@ -140,35 +193,39 @@ func (g *GameServer) ManagePlayers() {
 		if !playersActive {
 			g.Logger.Info("no more players, closing room", "numPlayers", len(g.Players), "playTime", time.Since(g.StartTime).String(), "emulator", g.Emulator)
 			g.CloseServers()
-			g.Running = false
 			return
 		}
-		time.Sleep(time.Second * DisconnectTimeoutS)
 	}
 }
 
+// MonitorActivity closes rooms that were abandoned: lobby rooms that lost all their players, and
+// games that stopped sending input packets. A quiet lobby stays open, its host may be waiting for friends.
 func (g *GameServer) MonitorActivity() {
-	for g.Running {
-		if time.Since(g.LastActivity) > time.Second*DisconnectTimeoutS {
-			g.Logger.Info("No activity detected for 60 seconds, closing server.")
-			g.CloseServers()
-			return
-		}
-		if time.Since(g.LastPacketReceived) > time.Second*60 {
-			g.Logger.Info("No packets received for 60 seconds, closing server.")
-			g.CloseServers()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	ended := g.Ended()
+	for {
+		select {
+		case <-ended:
 			return
+		case <-ticker.C:
 		}
-		g.PlayersMutex.Lock()
-		noPlayers := len(g.Players) == 0
-		g.PlayersMutex.Unlock()
-		if noPlayers {
-			g.Logger.Info("No players online, restarting server.")
-			g.CloseServers()
-			time.Sleep(time.Second * 10) // Wait for 10 seconds before restarting
-			g.CreateNetworkServers(g.Port, 1, g.GameName, g.GameName, g.PlayerName, g.Logger)
+		switch g.State() {
+		case StateLobby:
+			g.PlayersMutex.Lock()
+			noPlayers := len(g.Players) == 0
+			g.PlayersMutex.Unlock()
+			if noPlayers {
+				g.Logger.Info("no players in lobby, closing room")
+				g.CloseServers()
+			}
+		case StateRunning:
+			if time.Since(g.LastPacketReceived) > PacketTimeout {
+				g.Logger.Info("no packets received, closing room", "lastPacket", g.LastPacketReceived.Format(time.RFC3339))
+				g.CloseServers()
+			}
+		default:
 		}
-		time.Sleep(time.Minute * 2) // Check every 10 minutes
 	}
 }
 
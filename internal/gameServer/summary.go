@@ -0,0 +1,97 @@
+package gameserver
+
+import (
+	"sort"
+	"time"
+)
+
+// Reasons a player stopped playing before the room ended.
+const (
+	DisconnectUDPTimeout = "udp_timeout"       // no input requests for DisconnectTimeoutS
+	DisconnectNotice     = "disconnect_notice" // the client sent RequestDisconnectNotice
+	DisconnectReconnect  = "reconnect"         // the player dropped and had not finished rejoining
+)
+
+// PlayerSummary describes how one player's session went.
+type PlayerSummary struct {
+	Name            string  `json:"name"`
+	Disconnect      string  `json:"disconnect,omitempty"` // empty if the player was still playing when the room ended
+	Slot            int     `json:"slot"`
+	BufferSize      uint32  `json:"buffer_size"`
+	AvgCountLag     float64 `json:"avg_count_lag"`
+	AvgBufferHealth float64 `json:"avg_buffer_health"`
+}
+
+// connectionSamples adds up CountLag and BufferHealth each time ManageBuffer looks at a slot.
+type connectionSamples struct {
+	count    int
+	countLag uint64
+	health   int64
+}
+
+// GameSummary is reported to players and the log once a started game ends.
+type GameSummary struct {
+	Players    []PlayerSummary `json:"players"`
+	DurationMs int64           `json:"duration_ms"`
+	Desync     bool            `json:"desync"`
+	DesyncVI   uint32          `json:"desync_vi,omitempty"` // VI count at which the sync values first differed
+}
+
+// recordDisconnect keeps the first reason slot stopped playing. Callers hold GameDataMutex.
+func (g *GameServer) recordDisconnect(slot byte, reason string) {
+	if int(slot) < len(g.disconnects) && g.disconnects[slot] == "" {
+		g.disconnects[slot] = reason
+	}
+}
+
+// sampleConnections records the current lag and buffer health of every slot that reported any.
+func (g *GameServer) sampleConnections() {
+	g.GameDataMutex.Lock()
+	defer g.GameDataMutex.Unlock()
+	for i := range g.samples {
+		if g.GameData.BufferHealth[i] == -1 {
+			continue
+		}
+		g.samples[i].count++
+		g.samples[i].countLag += uint64(g.GameData.CountLag[i])
+		g.samples[i].health += int64(g.GameData.BufferHealth[i])
+	}
+}
+
+// Summary describes the game from StartTime until the room ended, or until now if it is still going.
+func (g *GameServer) Summary() GameSummary {
+	end := g.StateTime(StateEnded)
+	if end.IsZero() {
+		end = time.Now()
+	}
+	var summary GameSummary
+	if start := g.StateTime(StateStarting); !start.IsZero() {
+		summary.DurationMs = end.Sub(start).Milliseconds()
+	}
+
+	g.GameDataMutex.Lock()
+	summary.Desync = g.GameData.Status&StatusDesync != 0
+	summary.DesyncVI = g.desyncVI
+	disconnects := g.disconnects
+	samples := g.samples
+	var bufferSizes [4]uint32
+	copy(bufferSizes[:], g.GameData.BufferSize)
+	g.GameDataMutex.Unlock()
+
+	g.PlayersMutex.Lock()
+	for name, v := range g.Players {
+		player := PlayerSummary{Name: name, Slot: v.Number}
+		if v.Number >= 0 && v.Number < len(bufferSizes) {
+			player.BufferSize = bufferSizes[v.Number]
+			player.Disconnect = disconnects[v.Number]
+			if samples[v.Number].count > 0 {
+				player.AvgCountLag = float64(samples[v.Number].countLag) / float64(samples[v.Number].count)
+				player.AvgBufferHealth = float64(samples[v.Number].health) / float64(samples[v.Number].count)
+			}
+		}
+		summary.Players = append(summary.Players, player)
+	}
+	g.PlayersMutex.Unlock()
+	sort.Slice(summary.Players, func(i, j int) bool { return summary.Players[i].Slot < summary.Players[j].Slot })
+	return summary
+}
@@ -1,7 +1,6 @@
 package gameserver
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,15 +10,6 @@ import (
 	"time"
 )
 
-type TCPData struct {
-	Filename       string
-	Buffer         bytes.Buffer
-	Filesize       uint32
-	Request        byte
-	CustomID       byte
-	CustomDatasize uint32
-}
-
 const (
 	SettingsSize = 24
 	BufferTarget = 2
@@ -35,81 +25,156 @@ const (
 	RequestRegisterPlayer   = 5
 	RequestGetRegistration  = 6
 	RequestDisconnectNotice = 7
+	RequestSendSavestate    = 8
+	RequestReceiveSavestate = 9
+	RequestSendChunk        = 10
+	RequestTransferOffset   = 11
+	RequestReceiveChunk     = 12
+	RequestNegotiate        = 13
 	RequestSendCustomStart  = 64 // 64-127 are custom data send slots, 128-191 are custom data receive slots
 	CustomDataOffset        = 64
 )
 
-func (g *GameServer) tcpSendFile(tcpData *TCPData, conn *net.TCPConn) {
-	startTime := time.Now()
-	var ok bool
-	for !ok {
-		_, ok = g.TCPFiles[tcpData.Filename]
-		if !ok {
-			time.Sleep(time.Second)
-			if time.Since(startTime) > TCPTimeout {
-				g.Logger.Info("TCP connection timed out in tcpSendFile")
-				return
-			}
+// tcpWaiting is called each time a sender in waitTCP blocks, after the change it waits for can no
+// longer be missed. Tests replace it to know when a sender is waiting.
+var tcpWaiting = func() {}
+
+// tcpChanged returns a channel that is closed the next time uploads, settings, registrations or players change.
+func (g *GameServer) tcpChanged() <-chan struct{} {
+	g.tcpNotifyMutex.Lock()
+	defer g.tcpNotifyMutex.Unlock()
+	if g.tcpNotify == nil {
+		g.tcpNotify = make(chan struct{})
+	}
+	return g.tcpNotify
+}
+
+// notifyTCP wakes every sender waiting in waitTCP.
+func (g *GameServer) notifyTCP() {
+	g.tcpNotifyMutex.Lock()
+	defer g.tcpNotifyMutex.Unlock()
+	if g.tcpNotify != nil {
+		close(g.tcpNotify)
+	}
+	g.tcpNotify = make(chan struct{})
+}
+
+// NotifyPlayersChanged must be called after the lobby adds or removes entries in Players.
+func (g *GameServer) NotifyPlayersChanged() {
+	g.notifyTCP()
+}
+
+// waitTCP blocks until ready returns true, re-checking it each time the TCP state changes.
+// It returns false if TCPTimeout passes or the room ends first.
+func (g *GameServer) waitTCP(ready func() bool) bool {
+	timeout := time.NewTimer(TCPTimeout)
+	defer timeout.Stop()
+	ended := g.Ended()
+	for {
+		changed := g.tcpChanged() // taken before checking so a change in between is not missed
+		if ready() {
+			return true
+		}
+		tcpWaiting()
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return false
+		case <-ended:
+			return false
+		}
+	}
+}
+
+// waitForData blocks until the save filename, or the custom data slot customID if it is not 0, has been uploaded.
+// compressed reports whether the data is stored as a gzip stream.
+// In rooms with VaultSaves every player, the host included, gets the vault copy of a save, so nobody
+// boots a different save than the others. Files the vault does not have wait for an upload as usual.
+func (g *GameServer) waitForData(filename string, customID byte) (data []byte, compressed bool, ready bool) {
+	if customID == 0 && g.VaultSaves {
+		if data := g.vaultCopy(filename); data != nil {
+			g.Logger.Info("serving file from vault", "filename", filename, "filesize", len(data))
+			return data, false, true
+		}
+	}
+
+	ready = g.waitTCP(func() bool {
+		var ok bool
+		key := filename
+		g.TCPFilesMutex.Lock()
+		if customID != 0 {
+			data, ok = g.CustomData[customID]
+			key = uploadKey(&TCPRequest{CustomID: customID})
 		} else {
-			_, err := conn.Write(g.TCPFiles[tcpData.Filename])
-			if err != nil {
-				g.Logger.Error(err, "could not write file", "address", conn.RemoteAddr().String())
-			}
-			// g.Logger.Info("sent file", "filename", tcpData.Filename, "filesize", tcpData.Filesize, "address", conn.RemoteAddr().String())
-			tcpData.Filename = ""
-			tcpData.Filesize = 0
+			data, ok = g.TCPFiles[filename]
 		}
+		compressed = g.compressedUploads[key]
+		g.TCPFilesMutex.Unlock()
+		return ok
+	})
+	return data, compressed, ready
+}
+
+func (g *GameServer) tcpSendFile(filename string, compressed bool, conn *net.TCPConn) {
+	data, storedCompressed, ready := g.waitForData(filename, 0)
+	if !ready {
+		g.Logger.Info("TCP connection timed out in tcpSendFile")
+		return
+	}
+	err := g.writePayload(conn, filename, data, storedCompressed, compressed)
+	if err != nil {
+		g.Logger.Error(err, "could not write file", "address", conn.RemoteAddr().String())
 	}
+	// g.Logger.Info("sent file", "filename", filename, "address", conn.RemoteAddr().String())
 }
 
 func (g *GameServer) tcpSendSettings(conn *net.TCPConn) {
-	startTime := time.Now()
-	for !g.HasSettings {
-		time.Sleep(time.Second)
-		if time.Since(startTime) > TCPTimeout {
-			g.Logger.Info("TCP connection timed out in tcpSendSettings")
-			return
-		}
+	settings := make([]byte, SettingsSize)
+	ready := g.waitTCP(func() bool {
+		g.TCPFilesMutex.Lock()
+		defer g.TCPFilesMutex.Unlock()
+		copy(settings, g.TCPSettings)
+		return g.HasSettings
+	})
+	if !ready {
+		g.Logger.Info("TCP connection timed out in tcpSendSettings")
+		return
 	}
-	_, err := conn.Write(g.TCPSettings)
+	_, err := conn.Write(settings)
 	if err != nil {
 		g.Logger.Error(err, "could not write settings", "address", conn.RemoteAddr().String())
 	}
 	// g.Logger.Info("sent settings", "address", conn.RemoteAddr().String())
 }
 
-func (g *GameServer) tcpSendCustom(conn *net.TCPConn, customID byte) {
-	startTime := time.Now()
-	var ok bool
-	for !ok {
-		_, ok = g.CustomData[customID]
-		if !ok {
-			time.Sleep(time.Second)
-			if time.Since(startTime) > TCPTimeout {
-				g.Logger.Info("TCP connection timed out in tcpSendCustom")
-				return
-			}
-		} else {
-			_, err := conn.Write(g.CustomData[customID])
-			if err != nil {
-				g.Logger.Error(err, "could not write data", "address", conn.RemoteAddr().String())
-			}
-		}
+func (g *GameServer) tcpSendCustom(conn *net.TCPConn, customID byte, compressed bool) {
+	data, storedCompressed, ready := g.waitForData("", customID)
+	if !ready {
+		g.Logger.Info("TCP connection timed out in tcpSendCustom")
+		return
+	}
+	err := g.writePayload(conn, uploadKey(&TCPRequest{CustomID: customID}), data, storedCompressed, compressed)
+	if err != nil {
+		g.Logger.Error(err, "could not write data", "address", conn.RemoteAddr().String())
 	}
 }
 
 func (g *GameServer) tcpSendReg(conn *net.TCPConn) {
-	startTime := time.Now()
-	for len(g.Players) != len(g.Registrations) {
-		time.Sleep(time.Second)
-		if time.Since(startTime) > TCPTimeout {
-			g.Logger.Info("TCP connection timed out in tcpSendReg")
-			return
-		}
+	ready := g.waitTCP(func() bool {
+		g.PlayersMutex.Lock()
+		defer g.PlayersMutex.Unlock()
+		g.RegistrationsMutex.Lock()
+		defer g.RegistrationsMutex.Unlock()
+		return len(g.Players) == len(g.Registrations)
+	})
+	if !ready {
+		g.Logger.Info("TCP connection timed out in tcpSendReg")
+		return
 	}
 	var i byte
 	registrations := make([]byte, 24) //nolint:gomnd,mnd
 	current := 0
+	g.RegistrationsMutex.Lock()
 	for i = 0; i < 4; i++ {
 		_, ok := g.Registrations[i]
 		if ok {
@@ -123,6 +188,7 @@ func (g *GameServer) tcpSendReg(conn *net.TCPConn) {
 			current += 6
 		}
 	}
+	g.RegistrationsMutex.Unlock()
 	// g.Logger.Info("sent registration data", "address", conn.RemoteAddr().String())
 	_, err := conn.Write(registrations)
 	if err != nil {
@@ -130,10 +196,179 @@ func (g *GameServer) tcpSendReg(conn *net.TCPConn) {
 	}
 }
 
+func (g *GameServer) tcpRegisterPlayer(request *TCPRequest, conn *net.TCPConn) {
+	response := make([]byte, 2) //nolint:gomnd,mnd
+	playerNumber := request.PlayerNumber
+	plugin := request.Plugin
+	if playerNumber > 3 { //nolint:gomnd,mnd
+		g.Logger.Error(fmt.Errorf("registration failure"), "invalid player number", "number", playerNumber, "address", conn.RemoteAddr().String())
+	} else if _, ok := g.Registrations[playerNumber]; !ok {
+		plugin = g.PakPolicy.Allowed(playerNumber, plugin)
+		if plugin != request.Plugin {
+			g.Logger.Info("pak not allowed in this room", "requested", request.Plugin, "number", playerNumber, "address", conn.RemoteAddr().String())
+		}
+
+		g.RegistrationsMutex.Lock() // any player can modify this, which would be in a different thread
+		g.Registrations[playerNumber] = &Registration{
+			RegID:  request.RegID,
+			Plugin: plugin,
+			Raw:    request.Raw,
+		}
+		g.RegistrationsMutex.Unlock()
+
+		response[0] = 1
+		g.Logger.Info("registered player", "registration", g.Registrations[playerNumber], "number", playerNumber, "address", conn.RemoteAddr().String())
+
+		g.GameDataMutex.Lock() // any player can modify this, which would be in a different thread
+		g.GameData.PendingPlugin[playerNumber] = plugin
+		g.GameData.PlayerAlive[playerNumber] = true
+		g.GameDataMutex.Unlock()
+		g.notifyTCP()
+		g.checkAllRegistered()
+	} else {
+		if g.Registrations[playerNumber].RegID == request.RegID {
+			g.Logger.Error(fmt.Errorf("re-registration"), "player already registered", "registration", g.Registrations[playerNumber], "number", playerNumber, "address", conn.RemoteAddr().String())
+			response[0] = 1
+		} else {
+			g.Logger.Error(fmt.Errorf("registration failure"), "could not register player", "registration", g.Registrations[playerNumber], "number", playerNumber, "address", conn.RemoteAddr().String())
+			response[0] = 0
+		}
+	}
+	response[1] = BufferTarget
+	_, err := conn.Write(response)
+	if err != nil {
+		g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
+	}
+}
+
+func (g *GameServer) tcpDisconnectNotice(regID uint32, conn *net.TCPConn) {
+	var i byte
+	for i = 0; i < 4; i++ {
+		v, ok := g.Registrations[i]
+		if ok {
+			if v.RegID == regID {
+				g.Logger.Info("player disconnected TCP", "regID", regID, "player", i, "address", conn.RemoteAddr().String())
+
+				g.GameDataMutex.Lock() // any player can modify this, which would be in a different thread
+				g.GameData.PlayerAlive[i] = false
+				g.GameData.Status |= (0x1 << (i + 1)) //nolint:gomnd,mnd
+				g.recordDisconnect(i, DisconnectNotice)
+				g.GameDataMutex.Unlock()
+
+				g.RegistrationsMutex.Lock() // any player can modify this, which would be in a different thread
+				delete(g.Registrations, i)
+				g.RegistrationsMutex.Unlock()
+				g.notifyTCP()
+			}
+		}
+	}
+}
+
+// completeUpload keeps a fully received save or custom data upload. Compressed uploads are
+// stored as they are, but are expanded once here to validate them, hash them and fill the vault.
+// It reports whether the upload was kept.
+func (g *GameServer) completeUpload(request *TCPRequest, conn *net.TCPConn) bool {
+	raw := request.Data
+	if request.Compressed {
+		var err error
+		raw, err = g.decompressPayload(request.Data)
+		if err != nil {
+			g.Logger.Error(err, "dropping compressed upload", "key", uploadKey(request), "address", conn.RemoteAddr().String())
+			g.cancelUpload(uint32(len(request.Data)))
+			return false
+		}
+	}
+	if err := g.checkUploadHash(request, raw); err != nil {
+		g.Logger.Error(err, "upload does not match host report", "key", uploadKey(request), "strict", g.StrictDataCheck, "address", conn.RemoteAddr().String())
+		if g.StrictDataCheck { // the other players must not load data the host did not check
+			g.cancelUpload(uint32(len(request.Data)))
+			var rejection *TCPRejection
+			if errors.As(err, &rejection) {
+				g.sendRejection(conn, rejection)
+			}
+			return false
+		}
+	}
+	g.storeUpload(request, raw)
+	if request.Type == RequestSendSave {
+		g.storeInVault(request.Filename, raw)
+	}
+	return true
+}
+
+// handleTCPRequest acts on one decoded request. Requests that have to wait for
+// data from another player are answered from their own goroutine.
+func (g *GameServer) handleTCPRequest(request *TCPRequest, conn *net.TCPConn) {
+	switch {
+	case request.Type == RequestSendSave: // read in file from sender
+		g.completeUpload(request, conn)
+		// g.Logger.Info("read file from sender", "filename", request.Filename, "filesize", len(request.Data), "address", conn.RemoteAddr().String())
+	case request.Type == RequestReceiveSave: // send requested file
+		go g.tcpSendFile(request.Filename, request.Compressed, conn)
+	case request.Type == RequestSendSettings: // get settings from P1
+		g.TCPFilesMutex.Lock()
+		copy(g.TCPSettings, request.Data)
+		g.HasSettings = true
+		g.TCPFilesMutex.Unlock()
+		// g.Logger.Info("read settings via TCP", "address", conn.RemoteAddr().String())
+		g.notifyTCP()
+	case request.Type == RequestReceiveSettings: // send settings to P2-4
+		go g.tcpSendSettings(conn)
+	case request.Type == RequestRegisterPlayer:
+		g.tcpRegisterPlayer(request, conn)
+	case request.Type == RequestGetRegistration: // send registration
+		go g.tcpSendReg(conn)
+	case request.Type == RequestDisconnectNotice:
+		g.tcpDisconnectNotice(request.RegID, conn)
+	case request.Type == RequestSendSavestate: // savestate from a healthy player for a reconnecting one
+		if err := g.checkSavestateCount(request.Count); err != nil {
+			g.Logger.Error(err, "refusing savestate", "address", conn.RemoteAddr().String())
+			g.cancelUpload(uint32(len(request.Data)))
+			var rejection *TCPRejection
+			if errors.As(err, &rejection) {
+				g.sendRejection(conn, rejection)
+			}
+			return
+		}
+		if !g.completeUpload(request, conn) {
+			return
+		}
+		g.clearResyncRequest()
+		g.Logger.Info("received savestate for reconnecting player", "count", request.Count, "size", len(request.Data), "address", conn.RemoteAddr().String())
+	case request.Type == RequestReceiveSavestate:
+		go g.tcpSendSavestate(request.RegID, request.Compressed, conn)
+	case request.Type == RequestSendChunk:
+		g.tcpReceiveChunk(request, conn)
+	case request.Type == RequestTransferOffset:
+		g.tcpSendTransferOffset(request, conn)
+	case request.Type == RequestReceiveChunk:
+		go g.tcpSendChunk(request, conn)
+	case isCustomSend(request.Type): // get custom data (for example, plugin settings)
+		g.completeUpload(request, conn)
+	case isCustomReceive(request.Type): // send custom data (for example, plugin settings)
+		go g.tcpSendCustom(conn, request.CustomID, request.Compressed)
+	}
+}
+
 func (g *GameServer) processTCP(conn *net.TCPConn) {
 	defer conn.Close()
 
-	tcpData := &TCPData{Request: RequestNone}
+	var reserved uint32  // upload bytes accounted for but not yet stored
+	var compression byte // negotiated with RequestNegotiate
+	defer func() {
+		if reserved != 0 {
+			g.cancelUpload(reserved)
+		}
+	}()
+	parser := TCPParser{
+		CheckSize: func(request *TCPRequest, size uint32) error {
+			if err := g.reserveUpload(request, size); err != nil {
+				return err
+			}
+			reserved = size
+			return nil
+		},
+	}
 	incomingBuffer := make([]byte, 1500) //nolint:gomnd,mnd
 	for {
 		err := conn.SetReadDeadline(time.Now().Add(time.Second))
@@ -150,196 +385,32 @@ func (g *GameServer) processTCP(conn *net.TCPConn) {
 			continue
 		}
 		if length > 0 {
-			tcpData.Buffer.Write(incomingBuffer[:length])
-		}
-
-		if tcpData.Request == RequestNone { // find the request type
-			if tcpData.Buffer.Len() > 0 {
-				tcpData.Request, err = tcpData.Buffer.ReadByte()
-				if err != nil {
-					g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-				}
-			} else {
-				continue // nothing to do
-			}
-		}
-
-		if (tcpData.Request == RequestSendSave || tcpData.Request == RequestReceiveSave) && tcpData.Filename == "" { // get file name
-			if bytes.IndexByte(tcpData.Buffer.Bytes(), 0) != -1 {
-				filenameBytes, err := tcpData.Buffer.ReadBytes(0)
-				if err != nil {
-					g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-				}
-				tcpData.Filename = string(filenameBytes[:len(filenameBytes)-1])
-			}
-		}
-
-		if tcpData.Request == RequestSendSave && tcpData.Filename != "" && tcpData.Filesize == 0 { // get file size from sender
-			if tcpData.Buffer.Len() >= 4 { //nolint:gomnd,mnd
-				filesizeBytes := make([]byte, 4)
-				_, err = tcpData.Buffer.Read(filesizeBytes)
-				if err != nil {
-					g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-				}
-				tcpData.Filesize = binary.BigEndian.Uint32(filesizeBytes)
-			}
-		}
-
-		if tcpData.Request == RequestSendSave && tcpData.Filename != "" && tcpData.Filesize != 0 { // read in file from sender
-			if tcpData.Buffer.Len() >= int(tcpData.Filesize) {
-				g.TCPFiles[tcpData.Filename] = make([]byte, tcpData.Filesize)
-				_, err = tcpData.Buffer.Read(g.TCPFiles[tcpData.Filename])
-				if err != nil {
-					g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-				}
-				// g.Logger.Info("read file from sender", "filename", tcpData.Filename, "filesize", tcpData.Filesize, "address", conn.RemoteAddr().String())
-				tcpData.Filename = ""
-				tcpData.Filesize = 0
-				tcpData.Request = RequestNone
-			}
+			parser.Write(incomingBuffer[:length])
 		}
 
-		if tcpData.Request == RequestReceiveSave && tcpData.Filename != "" { // send requested file
-			go g.tcpSendFile(tcpData, conn)
-			tcpData.Request = RequestNone
-		}
-
-		if tcpData.Request == RequestSendSettings { // get settings from P1
-			if tcpData.Buffer.Len() >= SettingsSize {
-				_, err = tcpData.Buffer.Read(g.TCPSettings)
-				if err != nil {
-					g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-				}
-				// g.Logger.Info("read settings via TCP", "bufferLeft", tcpData.Buffer.Len(), "address", conn.RemoteAddr().String())
-				g.HasSettings = true
-				tcpData.Request = RequestNone
-			}
-		}
-
-		if tcpData.Request == RequestReceiveSettings { // send settings to P2-4
-			go g.tcpSendSettings(conn)
-			tcpData.Request = RequestNone
-		}
-
-		if tcpData.Request == RequestRegisterPlayer && tcpData.Buffer.Len() >= 7 { // register player
-			playerNumber, err := tcpData.Buffer.ReadByte()
-			if err != nil {
-				g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-			}
-			plugin, err := tcpData.Buffer.ReadByte()
-			if err != nil {
-				g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-			}
-			raw, err := tcpData.Buffer.ReadByte()
-			if err != nil {
-				g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-			}
-			regIDBytes := make([]byte, 4) //nolint:gomnd,mnd
-			_, err = tcpData.Buffer.Read(regIDBytes)
+		for {
+			request, err := parser.Next()
 			if err != nil {
-				g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-			}
-			regID := binary.BigEndian.Uint32(regIDBytes)
-
-			response := make([]byte, 2) //nolint:gomnd,mnd
-			_, ok := g.Registrations[playerNumber]
-			if !ok {
-				if playerNumber > 0 && plugin == 2 { // Only P1 can use mempak
-					plugin = 1
-				}
-
-				g.RegistrationsMutex.Lock() // any player can modify this, which would be in a different thread
-				g.Registrations[playerNumber] = &Registration{
-					RegID:  regID,
-					Plugin: plugin,
-					Raw:    raw,
+				var rejection *TCPRejection
+				if errors.As(err, &rejection) {
+					g.sendRejection(conn, rejection)
 				}
-				g.RegistrationsMutex.Unlock()
-
-				response[0] = 1
-				g.Logger.Info("registered player", "registration", g.Registrations[playerNumber], "number", playerNumber, "bufferLeft", tcpData.Buffer.Len(), "address", conn.RemoteAddr().String())
-
-				g.GameDataMutex.Lock() // any player can modify this, which would be in a different thread
-				g.GameData.PendingPlugin[playerNumber] = plugin
-				g.GameData.PlayerAlive[playerNumber] = true
-				g.GameDataMutex.Unlock()
-			} else {
-				if g.Registrations[playerNumber].RegID == regID {
-					g.Logger.Error(fmt.Errorf("re-registration"), "player already registered", "registration", g.Registrations[playerNumber], "number", playerNumber, "bufferLeft", tcpData.Buffer.Len(), "address", conn.RemoteAddr().String())
-					response[0] = 1
-				} else {
-					g.Logger.Error(fmt.Errorf("registration failure"), "could not register player", "registration", g.Registrations[playerNumber], "number", playerNumber, "bufferLeft", tcpData.Buffer.Len(), "address", conn.RemoteAddr().String())
-					response[0] = 0
-				}
-			}
-			response[1] = BufferTarget
-			_, err = conn.Write(response)
-			if err != nil {
-				g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-			}
-			tcpData.Request = RequestNone
-		}
-
-		if tcpData.Request == RequestGetRegistration { // send registration
-			go g.tcpSendReg(conn)
-			tcpData.Request = RequestNone
-		}
-
-		if tcpData.Request == RequestDisconnectNotice && tcpData.Buffer.Len() >= 4 { // disconnect notice
-			regIDBytes := make([]byte, 4) //nolint:gomnd,mnd
-			_, err = tcpData.Buffer.Read(regIDBytes)
-			if err != nil {
-				g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
+				g.Logger.Error(err, "TCP error, closing connection", "bufferLeft", parser.Buffered(), "address", conn.RemoteAddr().String())
+				return
 			}
-			regID := binary.BigEndian.Uint32(regIDBytes)
-			var i byte
-			for i = 0; i < 4; i++ {
-				v, ok := g.Registrations[i]
-				if ok {
-					if v.RegID == regID {
-						g.Logger.Info("player disconnected TCP", "regID", regID, "player", i, "address", conn.RemoteAddr().String())
-
-						g.GameDataMutex.Lock() // any player can modify this, which would be in a different thread
-						g.GameData.PlayerAlive[i] = false
-						g.GameData.Status |= (0x1 << (i + 1)) //nolint:gomnd,mnd
-						g.GameDataMutex.Unlock()
-
-						g.RegistrationsMutex.Lock() // any player can modify this, which would be in a different thread
-						delete(g.Registrations, i)
-						g.RegistrationsMutex.Unlock()
-					}
-				}
+			if request == nil {
+				break
 			}
-			tcpData.Request = RequestNone
-		}
-
-		if tcpData.Request >= RequestSendCustomStart && tcpData.Request < RequestSendCustomStart+CustomDataOffset && tcpData.Buffer.Len() >= 4 && tcpData.CustomID == 0 { // get custom data (for example, plugin settings)
-			dataSizeBytes := make([]byte, 4) //nolint:gomnd,mnd
-			_, err = tcpData.Buffer.Read(dataSizeBytes)
-			if err != nil {
-				g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
+			if request.Type == RequestNegotiate {
+				compression = g.tcpNegotiate(request.Flags, conn)
+				continue
 			}
-			tcpData.CustomID = tcpData.Request
-			tcpData.CustomDatasize = binary.BigEndian.Uint32(dataSizeBytes)
-		}
-
-		if tcpData.Request >= RequestSendCustomStart && tcpData.Request < RequestSendCustomStart+CustomDataOffset && tcpData.CustomID != 0 { // read in custom data from sender
-			if tcpData.Buffer.Len() >= int(tcpData.CustomDatasize) {
-				g.CustomData[tcpData.CustomID] = make([]byte, tcpData.CustomDatasize)
-				_, err = tcpData.Buffer.Read(g.CustomData[tcpData.CustomID])
-				if err != nil {
-					g.Logger.Error(err, "TCP error", "address", conn.RemoteAddr().String())
-				}
-				tcpData.CustomID = 0
-				tcpData.CustomDatasize = 0
-				tcpData.Request = RequestNone
+			request.Compressed = compression&CompressionGzip != 0
+			g.handleTCPRequest(request, conn)
+			if request.Type == RequestSendSave || request.Type == RequestSendSavestate || isCustomSend(request.Type) {
+				reserved = 0
 			}
 		}
-
-		if tcpData.Request >= RequestSendCustomStart+CustomDataOffset && tcpData.Request < RequestSendCustomStart+CustomDataOffset+CustomDataOffset { // send custom data (for example, plugin settings)
-			go g.tcpSendCustom(conn, tcpData.Request-CustomDataOffset)
-			tcpData.Request = RequestNone
-		}
 	}
 }
 
@@ -385,6 +456,10 @@ func (g *GameServer) createTCPServer(basePort int, maxGames int) int {
 			g.Logger.Info("Created TCP server", "port", g.Port)
 			g.TCPFiles = make(map[string][]byte)
 			g.CustomData = make(map[byte][]byte)
+			g.uploadSizes = make(map[string]int64)
+			g.uploadHashes = make(map[string]string)
+			g.partialUploads = make(map[string]*partialUpload)
+			g.compressedUploads = make(map[string]bool)
 			g.TCPSettings = make([]byte, SettingsSize)
 			g.Registrations = map[byte]*Registration{}
 			go g.watchTCP()
@@ -0,0 +1,121 @@
+package gameserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	pollInterval = time.Second      // how often the senders checked for data before they waited on changes
+	wakeLatency  = pollInterval / 4 // well under a poll, with room for -race and busy machines
+)
+
+func newTestGameServer() *GameServer {
+	g := &GameServer{Logger: logr.Discard()}
+	g.releaseUploads()
+	return g
+}
+
+// waiting returns a channel that gets a value each time a sender starts waiting in waitTCP.
+func waiting(t *testing.T) chan struct{} {
+	t.Helper()
+	waiters := make(chan struct{}, 1)
+	tcpWaiting = func() {
+		select {
+		case waiters <- struct{}{}:
+		default:
+		}
+	}
+	t.Cleanup(func() { tcpWaiting = func() {} })
+	return waiters
+}
+
+func waitForWaiter(t *testing.T, waiters chan struct{}) {
+	t.Helper()
+	select {
+	case <-waiters:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender never started waiting")
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (server *net.TCPConn, client *net.TCPConn) {
+	t.Helper()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err = net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+func TestReceiveSaveWakesOnUpload(t *testing.T) {
+	g := newTestGameServer()
+	server, client := tcpPair(t)
+	save := []byte("save data")
+	waiters := waiting(t)
+	go g.tcpSendFile("save.eep", false, server) // the waiter of a RequestReceiveSave
+
+	waitForWaiter(t, waiters)
+	uploaded := time.Now()
+	g.storeUpload(&TCPRequest{Type: RequestSendSave, Filename: "save.eep", Data: save}, save)
+
+	received := make([]byte, len(save))
+	if err := client.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, received); err != nil {
+		t.Fatalf("save was not sent: %s", err.Error())
+	}
+	if latency := time.Since(uploaded); latency > wakeLatency {
+		t.Fatalf("save was sent %s after the upload, want under %s", latency, wakeLatency)
+	}
+	if string(received) != string(save) {
+		t.Fatalf("got %q, want %q", received, save)
+	}
+}
+
+func TestWaitTCPEndsWithRoom(t *testing.T) {
+	g := newTestGameServer()
+	if err := g.Transition(StateLobby); err != nil {
+		t.Fatal(err)
+	}
+	waiters := waiting(t)
+	done := make(chan bool)
+	go func() {
+		_, _, ready := g.waitForData("save.eep", 0)
+		done <- ready
+	}()
+
+	waitForWaiter(t, waiters)
+	closed := time.Now()
+	g.end()
+	select {
+	case ready := <-done:
+		if ready {
+			t.Fatal("waiter reported data in a room that closed without any")
+		}
+		if latency := time.Since(closed); latency > wakeLatency {
+			t.Fatalf("waiter exited %s after the room closed, want under %s", latency, wakeLatency)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter did not exit when the room closed")
+	}
+}
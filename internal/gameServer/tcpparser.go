@@ -0,0 +1,306 @@
+package gameserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// TCPRequest is a single fully decoded request from the TCP channel.
+type TCPRequest struct {
+	Filename     string // RequestSendSave, RequestReceiveSave, chunked transfers of a save
+	Data         []byte // RequestSendSave, RequestSendSettings, RequestSendSavestate, RequestSendChunk, custom send slots
+	RegID        uint32 // RequestRegisterPlayer, RequestDisconnectNotice, RequestReceiveSavestate
+	Count        uint32 // RequestSendSavestate
+	Total        uint32 // RequestSendChunk
+	Offset       uint32 // RequestSendChunk, RequestReceiveChunk
+	Length       uint32 // RequestReceiveChunk, the most the client wants in one chunk
+	Checksum     uint32 // RequestSendChunk, CRC-32 (IEEE) of Data
+	Type         byte
+	PlayerNumber byte // RequestRegisterPlayer
+	Plugin       byte // RequestRegisterPlayer
+	Raw          byte // RequestRegisterPlayer
+	CustomID     byte // custom send and receive slots and chunked transfers of custom data, always in the send range
+	Flags        byte // RequestNegotiate
+	Compressed   bool // set by the connection, not the parser, once compression has been negotiated
+}
+
+type tcpParserState int
+
+const (
+	tcpStateRequest tcpParserState = iota
+	tcpStateFilename
+	tcpStateFilesize
+	tcpStateFileData
+	tcpStateSettings
+	tcpStateRegister
+	tcpStateDisconnect
+	tcpStateCustomSize
+	tcpStateCustomData
+	tcpStateSavestateCount
+	tcpStateSavestateData
+	tcpStateChunkTarget
+	tcpStateChunkCustomID
+	tcpStateChunkHeader
+	tcpStateChunkData
+	tcpStateChunkRange
+	tcpStateNegotiate
+)
+
+const (
+	registerRequestSize   = 7
+	disconnectRequestSize = 4
+	countFieldSize        = 4
+	sizeFieldSize         = 4
+	chunkHeaderSize       = 16
+	chunkRangeSize        = 8
+)
+
+const (
+	chunkTargetSave   = 0
+	chunkTargetCustom = 1
+)
+
+// TCPParser turns the raw byte stream of one TCP connection into TCPRequests.
+// It has no knowledge of the GameServer, so it can be driven directly with captured client traffic.
+type TCPParser struct {
+	// CheckSize is called with the declared size of an upload before any of it is buffered,
+	// returning an error stops the parser.
+	CheckSize func(request *TCPRequest, size uint32) error
+	buffer    bytes.Buffer
+	current   TCPRequest
+	size      uint32
+	state     tcpParserState
+}
+
+func isCustomSend(request byte) bool {
+	return request >= RequestSendCustomStart && request < RequestSendCustomStart+CustomDataOffset
+}
+
+func isCustomReceive(request byte) bool {
+	return request >= RequestSendCustomStart+CustomDataOffset && request < RequestSendCustomStart+CustomDataOffset+CustomDataOffset
+}
+
+// Write appends data read from the connection to the parser.
+func (p *TCPParser) Write(data []byte) {
+	p.buffer.Write(data)
+}
+
+// Buffered returns the number of bytes received but not yet consumed by a request.
+func (p *TCPParser) Buffered() int {
+	return p.buffer.Len()
+}
+
+// Next returns the next complete request, or nil if more data is needed.
+// An error means the stream can not be decoded any further and the connection should be dropped.
+func (p *TCPParser) Next() (*TCPRequest, error) {
+	for {
+		done, more, err := p.step()
+		if err != nil || !more {
+			return nil, err
+		}
+		if done {
+			request := p.current
+			p.reset()
+			return &request, nil
+		}
+	}
+}
+
+func (p *TCPParser) reset() {
+	p.current = TCPRequest{}
+	p.size = 0
+	p.state = tcpStateRequest
+}
+
+// step advances the state machine once. done is set when p.current holds a complete request,
+// more is cleared when the buffer does not hold enough data to make progress.
+func (p *TCPParser) step() (done bool, more bool, err error) {
+	switch p.state {
+	case tcpStateRequest:
+		if p.buffer.Len() == 0 {
+			return false, false, nil
+		}
+		request, _ := p.buffer.ReadByte()
+		p.current.Type = request
+		switch {
+		case request == RequestSendSave || request == RequestReceiveSave:
+			p.state = tcpStateFilename
+		case request == RequestSendSettings:
+			p.state = tcpStateSettings
+		case request == RequestReceiveSettings || request == RequestGetRegistration:
+			return true, true, nil
+		case request == RequestRegisterPlayer:
+			p.state = tcpStateRegister
+		case request == RequestDisconnectNotice || request == RequestReceiveSavestate:
+			p.state = tcpStateDisconnect
+		case request == RequestSendSavestate:
+			p.state = tcpStateSavestateCount
+		case request == RequestSendChunk || request == RequestTransferOffset || request == RequestReceiveChunk:
+			p.state = tcpStateChunkTarget
+		case request == RequestNegotiate:
+			p.state = tcpStateNegotiate
+		case isCustomSend(request):
+			p.current.CustomID = request
+			p.state = tcpStateCustomSize
+		case isCustomReceive(request):
+			p.current.CustomID = request - CustomDataOffset
+			return true, true, nil
+		default:
+			return false, false, &TCPRejection{Reason: RejectUnknownRequest, Message: fmt.Sprintf("unknown TCP request %d", request)}
+		}
+		return false, true, nil
+
+	case tcpStateFilename:
+		end := bytes.IndexByte(p.buffer.Bytes(), 0)
+		if end == -1 {
+			if p.buffer.Len() > MaxFilenameLength {
+				return false, false, &TCPRejection{Reason: RejectBadFilename, Message: "filename too long"}
+			}
+			return false, false, nil
+		}
+		filenameBytes := p.buffer.Next(end + 1)
+		p.current.Filename = string(filenameBytes[:end])
+		if err := validateFilename(p.current.Filename); err != nil {
+			return false, false, err
+		}
+		if p.current.Type == RequestSendSave {
+			p.state = tcpStateFilesize
+			return false, true, nil
+		}
+		return p.chunkTargetDone()
+
+	case tcpStateNegotiate:
+		if p.buffer.Len() == 0 {
+			return false, false, nil
+		}
+		p.current.Flags, _ = p.buffer.ReadByte()
+		return true, true, nil
+
+	case tcpStateChunkTarget:
+		if p.buffer.Len() == 0 {
+			return false, false, nil
+		}
+		target, _ := p.buffer.ReadByte()
+		switch target {
+		case chunkTargetSave:
+			p.state = tcpStateFilename
+		case chunkTargetCustom:
+			p.state = tcpStateChunkCustomID
+		default:
+			return false, false, &TCPRejection{Reason: RejectUnknownRequest, Message: fmt.Sprintf("unknown chunk target %d", target)}
+		}
+		return false, true, nil
+
+	case tcpStateChunkCustomID:
+		if p.buffer.Len() == 0 {
+			return false, false, nil
+		}
+		customID, _ := p.buffer.ReadByte()
+		if !isCustomSend(customID) {
+			return false, false, &TCPRejection{Reason: RejectUnknownRequest, Message: fmt.Sprintf("invalid custom data slot %d", customID)}
+		}
+		p.current.CustomID = customID
+		return p.chunkTargetDone()
+
+	case tcpStateChunkHeader:
+		if p.buffer.Len() < chunkHeaderSize {
+			return false, false, nil
+		}
+		header := p.buffer.Next(chunkHeaderSize)
+		p.current.Total = binary.BigEndian.Uint32(header)
+		p.current.Offset = binary.BigEndian.Uint32(header[4:])
+		p.size = binary.BigEndian.Uint32(header[8:])
+		p.current.Checksum = binary.BigEndian.Uint32(header[12:])
+		if p.size > MaxChunkSize {
+			return false, false, &TCPRejection{Reason: RejectFileTooLarge, Message: fmt.Sprintf("chunk of %d bytes is larger than %d", p.size, MaxChunkSize)}
+		}
+		p.state = tcpStateChunkData
+		return false, true, nil
+
+	case tcpStateChunkRange:
+		if p.buffer.Len() < chunkRangeSize {
+			return false, false, nil
+		}
+		data := p.buffer.Next(chunkRangeSize)
+		p.current.Offset = binary.BigEndian.Uint32(data)
+		p.current.Length = binary.BigEndian.Uint32(data[4:])
+		return true, true, nil
+
+	case tcpStateSavestateCount:
+		if p.buffer.Len() < countFieldSize {
+			return false, false, nil
+		}
+		p.current.Count = binary.BigEndian.Uint32(p.buffer.Next(countFieldSize))
+		p.state = tcpStateCustomSize
+		return false, true, nil
+
+	case tcpStateFilesize, tcpStateCustomSize:
+		if p.buffer.Len() < sizeFieldSize {
+			return false, false, nil
+		}
+		p.size = binary.BigEndian.Uint32(p.buffer.Next(sizeFieldSize))
+		if p.CheckSize != nil {
+			if err := p.CheckSize(&p.current, p.size); err != nil {
+				return false, false, err
+			}
+		}
+		switch {
+		case p.state == tcpStateFilesize:
+			p.state = tcpStateFileData
+		case p.current.Type == RequestSendSavestate:
+			p.state = tcpStateSavestateData
+		default:
+			p.state = tcpStateCustomData
+		}
+		return false, true, nil
+
+	case tcpStateFileData, tcpStateCustomData, tcpStateSavestateData, tcpStateChunkData:
+		if uint64(p.buffer.Len()) < uint64(p.size) {
+			return false, false, nil
+		}
+		p.current.Data = make([]byte, p.size)
+		copy(p.current.Data, p.buffer.Next(int(p.size)))
+		return true, true, nil
+
+	case tcpStateSettings:
+		if p.buffer.Len() < SettingsSize {
+			return false, false, nil
+		}
+		p.current.Data = make([]byte, SettingsSize)
+		copy(p.current.Data, p.buffer.Next(SettingsSize))
+		return true, true, nil
+
+	case tcpStateRegister:
+		if p.buffer.Len() < registerRequestSize {
+			return false, false, nil
+		}
+		data := p.buffer.Next(registerRequestSize)
+		p.current.PlayerNumber = data[0]
+		p.current.Plugin = data[1]
+		p.current.Raw = data[2]
+		p.current.RegID = binary.BigEndian.Uint32(data[3:])
+		return true, true, nil
+
+	case tcpStateDisconnect:
+		if p.buffer.Len() < disconnectRequestSize {
+			return false, false, nil
+		}
+		p.current.RegID = binary.BigEndian.Uint32(p.buffer.Next(disconnectRequestSize))
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("invalid TCP parser state %d", p.state)
+}
+
+// chunkTargetDone moves on once the file or custom data slot of a request has been read.
+func (p *TCPParser) chunkTargetDone() (bool, bool, error) {
+	switch p.current.Type {
+	case RequestSendChunk:
+		p.state = tcpStateChunkHeader
+		return false, true, nil
+	case RequestReceiveChunk:
+		p.state = tcpStateChunkRange
+		return false, true, nil
+	}
+	return true, true, nil // RequestReceiveSave, RequestTransferOffset
+}
@@ -0,0 +1,233 @@
+package gameserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testMaxFileSize stands in for the server's upload limit, so oversized uploads are refused
+// the way reserveUpload refuses them.
+const testMaxFileSize = 1024
+
+func checkTestSize(_ *TCPRequest, size uint32) error {
+	if size > testMaxFileSize {
+		return &TCPRejection{Reason: RejectFileTooLarge, Message: fmt.Sprintf("upload of %d bytes is larger than %d", size, testMaxFileSize)}
+	}
+	return nil
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func name(filename string) []byte {
+	return append([]byte(filename), 0)
+}
+
+// wireRequest is one request as it appears on the wire, and what the parser must decode from it.
+// The bytes are built by hand from the wire format, no recorded client traffic is checked in.
+type wireRequest struct {
+	input []byte
+	want  TCPRequest
+}
+
+// releasedRequests are the request types released clients send: saves, settings, registration,
+// disconnect notices and custom data.
+var releasedRequests = []wireRequest{
+	{cat([]byte{RequestSendSave}, name("SUPER MARIO 64.eep"), u32(4), []byte{0xde, 0xad, 0xbe, 0xef}), TCPRequest{Type: RequestSendSave, Filename: "SUPER MARIO 64.eep", Data: []byte{0xde, 0xad, 0xbe, 0xef}}},
+	{cat([]byte{RequestReceiveSave}, name("SUPER MARIO 64.eep")), TCPRequest{Type: RequestReceiveSave, Filename: "SUPER MARIO 64.eep"}},
+	{cat([]byte{RequestSendSettings}, bytes.Repeat([]byte{0x01}, SettingsSize)), TCPRequest{Type: RequestSendSettings, Data: bytes.Repeat([]byte{0x01}, SettingsSize)}},
+	{[]byte{RequestReceiveSettings}, TCPRequest{Type: RequestReceiveSettings}},
+	{cat([]byte{RequestRegisterPlayer, 1, 2, 0}, u32(0x12345678)), TCPRequest{Type: RequestRegisterPlayer, PlayerNumber: 1, Plugin: 2, RegID: 0x12345678}},
+	{[]byte{RequestGetRegistration}, TCPRequest{Type: RequestGetRegistration}},
+	{cat([]byte{RequestDisconnectNotice}, u32(0x12345678)), TCPRequest{Type: RequestDisconnectNotice, RegID: 0x12345678}},
+	{cat([]byte{RequestSendCustomStart + 1}, u32(2), []byte{9, 9}), TCPRequest{Type: RequestSendCustomStart + 1, CustomID: RequestSendCustomStart + 1, Data: []byte{9, 9}}},
+	{[]byte{RequestSendCustomStart + CustomDataOffset + 1}, TCPRequest{Type: RequestSendCustomStart + CustomDataOffset + 1, CustomID: RequestSendCustomStart + 1}},
+}
+
+// newRequests are the request types no released client sends yet: savestates, chunked
+// transfers and negotiation.
+var newRequests = []wireRequest{
+	{cat([]byte{RequestSendSavestate}, u32(600), u32(3), []byte{1, 2, 3}), TCPRequest{Type: RequestSendSavestate, Count: 600, Data: []byte{1, 2, 3}}},
+	{cat([]byte{RequestReceiveSavestate}, u32(0x12345678)), TCPRequest{Type: RequestReceiveSavestate, RegID: 0x12345678}},
+	{cat([]byte{RequestSendChunk, chunkTargetSave}, name("save.sra"), u32(10), u32(4), u32(2), u32(0xcafef00d), []byte{7, 8}), TCPRequest{Type: RequestSendChunk, Filename: "save.sra", Total: 10, Offset: 4, Checksum: 0xcafef00d, Data: []byte{7, 8}}},
+	{cat([]byte{RequestSendChunk, chunkTargetCustom, RequestSendCustomStart + 2}, u32(2), u32(0), u32(2), u32(1), []byte{5, 6}), TCPRequest{Type: RequestSendChunk, CustomID: RequestSendCustomStart + 2, Total: 2, Checksum: 1, Data: []byte{5, 6}}},
+	{cat([]byte{RequestTransferOffset, chunkTargetSave}, name("save.sra")), TCPRequest{Type: RequestTransferOffset, Filename: "save.sra"}},
+	{cat([]byte{RequestReceiveChunk, chunkTargetSave}, name("save.sra"), u32(8), u32(4096)), TCPRequest{Type: RequestReceiveChunk, Filename: "save.sra", Offset: 8, Length: 4096}},
+	{[]byte{RequestNegotiate, 1}, TCPRequest{Type: RequestNegotiate, Flags: 1}},
+}
+
+var allRequests = append(append([]wireRequest(nil), releasedRequests...), newRequests...)
+
+var negotiate = newRequests[len(newRequests)-1].input
+
+// parse feeds input to a new parser in pieces of the given sizes, the rest in one piece,
+// and returns every request it decoded along with the error that stopped it, if any.
+func parse(t testing.TB, input []byte, splits []int) ([]TCPRequest, error) {
+	t.Helper()
+	p := TCPParser{CheckSize: checkTestSize}
+	var requests []TCPRequest
+	written := 0
+	for len(splits) > 0 || written < len(input) {
+		n := len(input) - written
+		if len(splits) > 0 {
+			if splits[0] < n {
+				n = splits[0]
+			}
+			splits = splits[1:]
+		}
+		p.Write(input[written : written+n])
+		written += n
+		for {
+			request, err := p.Next()
+			if p.Buffered() > written {
+				t.Fatalf("parser holds %d bytes but only %d were written", p.Buffered(), written)
+			}
+			if err != nil {
+				return requests, err
+			}
+			if request == nil {
+				break
+			}
+			if len(request.Data) > written {
+				t.Fatalf("request carries %d bytes of data but only %d were written", len(request.Data), written)
+			}
+			requests = append(requests, *request)
+		}
+	}
+	return requests, nil
+}
+
+func rejectionReason(err error) byte {
+	var rejection *TCPRejection
+	if errors.As(err, &rejection) {
+		return rejection.Reason
+	}
+	return 0
+}
+
+func testRequests(t *testing.T, requests []wireRequest) {
+	for _, request := range requests {
+		request := request
+		t.Run(fmt.Sprintf("request %d", request.want.Type), func(t *testing.T) {
+			got, err := parse(t, request.input, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if len(got) != 1 || !reflect.DeepEqual(got[0], request.want) {
+				t.Fatalf("got %+v, want %+v", got, request.want)
+			}
+		})
+	}
+}
+
+func TestTCPParserReleasedRequests(t *testing.T) {
+	testRequests(t, releasedRequests)
+}
+
+func TestTCPParserNewRequests(t *testing.T) {
+	testRequests(t, newRequests)
+}
+
+func TestTCPParserStream(t *testing.T) {
+	var stream []byte
+	var want []TCPRequest
+	for _, request := range allRequests {
+		stream = append(stream, request.input...)
+		want = append(want, request.want)
+	}
+	for _, size := range []int{1, 2, 3, 5, 7, 16, 64} {
+		var splits []int
+		for i := 0; i < len(stream); i += size {
+			splits = append(splits, size)
+		}
+		t.Run(fmt.Sprintf("reads of %d", size), func(t *testing.T) {
+			got, err := parse(t, stream, splits)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestTCPParserIncomplete(t *testing.T) {
+	for _, request := range allRequests {
+		got, err := parse(t, request.input[:len(request.input)-1], nil)
+		if err != nil || len(got) != 0 {
+			t.Fatalf("request %d: got %+v and %v from an incomplete request", request.want.Type, got, err)
+		}
+	}
+}
+
+func TestTCPParserRejections(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		reason byte
+	}{
+		{"oversize save", cat([]byte{RequestSendSave}, name("big.eep"), u32(testMaxFileSize+1)), RejectFileTooLarge},
+		{"oversize savestate", cat([]byte{RequestSendSavestate}, u32(1), u32(0xffffffff)), RejectFileTooLarge},
+		{"oversize custom data", cat([]byte{RequestSendCustomStart}, u32(testMaxFileSize+1)), RejectFileTooLarge},
+		{"oversize chunk", cat([]byte{RequestSendChunk, chunkTargetSave}, name("save.sra"), u32(MaxChunkSize*2), u32(0), u32(MaxChunkSize+1), u32(0)), RejectFileTooLarge},
+		{"path in filename", cat([]byte{RequestReceiveSave}, name("../save.sra")), RejectBadFilename},
+		{"empty filename", cat([]byte{RequestSendSave}, name("")), RejectBadFilename},
+		{"control character in filename", cat([]byte{RequestReceiveSave}, name("save\n.sra")), RejectBadFilename},
+		{"unterminated filename", cat([]byte{RequestSendSave}, bytes.Repeat([]byte{'a'}, MaxFilenameLength+1)), RejectBadFilename},
+		{"long filename", cat([]byte{RequestSendSave}, name(string(bytes.Repeat([]byte{'a'}, MaxFilenameLength+1)))), RejectBadFilename},
+		{"unknown type", []byte{RequestNegotiate + 1}, RejectUnknownRequest},
+		{"unknown type past custom slots", []byte{RequestSendCustomStart + 2*CustomDataOffset}, RejectUnknownRequest},
+		{"unknown chunk target", []byte{RequestSendChunk, 2}, RejectUnknownRequest},
+		{"chunk of receive slot", []byte{RequestSendChunk, chunkTargetCustom, RequestSendCustomStart + CustomDataOffset}, RejectUnknownRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a valid request first, to check the rejection does not lose what came before it
+			requests, err := parse(t, cat(negotiate, test.input), []int{1})
+			if reason := rejectionReason(err); reason != test.reason {
+				t.Fatalf("got rejection %d (%v), want %d", reason, err, test.reason)
+			}
+			if len(requests) != 1 || requests[0].Type != RequestNegotiate {
+				t.Fatalf("got %+v before the rejection, want the negotiate request", requests)
+			}
+		})
+	}
+}
+
+// FuzzTCPParser feeds arbitrary bytes in arbitrary reads. However the stream is split up, the parser
+// must decode the same requests and stop with the same rejection as when it gets the stream in one
+// read, and it must never hold or hand out more bytes than it was given.
+func FuzzTCPParser(f *testing.F) {
+	var stream []byte
+	for _, request := range allRequests {
+		f.Add(request.input, []byte{1})
+		stream = append(stream, request.input...)
+	}
+	f.Add(stream, []byte{3, 1, 4, 1, 5, 9, 2, 6})
+	f.Add(cat(releasedRequests[0].input, []byte{RequestNegotiate + 1}), []byte{2, 7})
+	f.Add(cat([]byte{RequestSendSave}, name("../x")), []byte{})
+	f.Fuzz(func(t *testing.T, input []byte, splitBytes []byte) {
+		splits := make([]int, len(splitBytes))
+		for i, v := range splitBytes {
+			splits[i] = int(v)
+		}
+		want, wantErr := parse(t, input, nil)
+		got, err := parse(t, input, splits)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("split reads decoded %+v, one read decoded %+v", got, want)
+		}
+		if (err == nil) != (wantErr == nil) || rejectionReason(err) != rejectionReason(wantErr) {
+			t.Fatalf("split reads stopped with %v, one read stopped with %v", err, wantErr)
+		}
+	})
+}
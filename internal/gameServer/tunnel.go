@@ -0,0 +1,99 @@
+package gameserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/net/websocket"
+)
+
+// writeInput sends a packet to a player over UDP, or over their websocket tunnel if they use one.
+func (g *GameServer) writeInput(data []byte, addr *net.UDPAddr) error {
+	g.tunnelsMutex.Lock()
+	tunnel, ok := g.tunnels[addr.String()]
+	g.tunnelsMutex.Unlock()
+	if ok {
+		return websocket.Message.Send(tunnel, data) //nolint:wrapcheck
+	}
+	if g.UDPListener == nil {
+		return fmt.Errorf("UDP server closed")
+	}
+	_, err := g.UDPListener.WriteToUDP(data, addr)
+	return err //nolint:wrapcheck
+}
+
+// handleInput passes a packet from either transport to processUDP, one at a time.
+func (g *GameServer) handleInput(addr *net.UDPAddr, buf []byte) {
+	g.inputMutex.Lock()
+	defer g.inputMutex.Unlock()
+	g.UpdateLastPacketReceived()
+	g.processUDP(addr, buf)
+}
+
+// ServeInputTunnel carries the same packets as the UDP server over a websocket, for players on
+// networks that block UDP. Each binary message is one packet in either direction. The tunnel
+// gets an address made from the websocket's remote address, so it takes the place of a UDP
+// address everywhere in GameData and rooms can mix both transports.
+func (g *GameServer) ServeInputTunnel(ws *websocket.Conn) {
+	defer ws.Close()
+
+	remote, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if err != nil {
+		g.Logger.Error(err, "could not resolve remote IP")
+		return
+	}
+	validated := false
+	g.PlayersMutex.Lock()
+	for _, v := range g.Players {
+		if remote.IP.Equal(net.ParseIP(v.IP)) {
+			validated = true
+		}
+	}
+	g.PlayersMutex.Unlock()
+	if !validated {
+		g.Logger.Error(fmt.Errorf("invalid input tunnel"), "bad IP", "IP", remote.IP)
+		return
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	addr := &net.UDPAddr{IP: remote.IP, Port: remote.Port, Zone: remote.Zone}
+	g.tunnelsMutex.Lock()
+	if g.tunnels == nil {
+		g.tunnels = make(map[string]*websocket.Conn)
+	}
+	g.tunnels[addr.String()] = ws
+	g.tunnelsMutex.Unlock()
+	defer func() {
+		g.tunnelsMutex.Lock()
+		delete(g.tunnels, addr.String())
+		g.tunnelsMutex.Unlock()
+		// without the tunnel the address would send UDP to the websocket's TCP port, so
+		// the player gets no input until they send a packet again over either transport
+		g.inputMutex.Lock()
+		for i, v := range g.GameData.PlayerAddresses {
+			if v != nil && v.String() == addr.String() {
+				g.GameData.PlayerAddresses[i] = nil
+			}
+		}
+		g.inputMutex.Unlock()
+	}()
+	g.Logger.Info("input tunnel opened", "address", addr.String())
+
+	for {
+		var packet []byte
+		if err := websocket.Message.Receive(ws, &packet); err != nil {
+			if !errors.Is(err, io.EOF) {
+				g.Logger.Info("input tunnel closed", "reason", err.Error(), "address", addr.String())
+			}
+			return
+		}
+		if len(packet) == 0 || len(packet) > 1500 { //nolint:gomnd,mnd
+			continue
+		}
+		buf := make([]byte, 1500) //nolint:gomnd,mnd // processUDP expects a full sized buffer like watchUDP reads into
+		copy(buf, packet)
+		g.handleInput(addr, buf)
+	}
+}
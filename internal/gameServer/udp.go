@@ -72,7 +72,7 @@ func (g *GameServer) sendUDPInput(count uint32, addr *net.UDPAddr, playerNumber
 
     if count > start {
         buffer[4] = uint8(count - start) // number of counts in packet
-        _, err := g.UDPListener.WriteToUDP(buffer[0:currentByte], addr)
+        err := g.writeInput(buffer[0:currentByte], addr)
         if err != nil {
             g.Logger.Error(err, "could not send input")
         }
@@ -89,9 +89,15 @@ func (g *GameServer) processUDP(addr *net.UDPAddr, buf []byte) {
         g.GameData.PendingInput[playerNumber] = binary.BigEndian.Uint32(buf[6:])
         g.GameData.PendingPlugin[playerNumber] = buf[10]
 
+        redundant := g.redundantInputs()
         for i := 0; i < 4; i++ {
             if g.GameData.PlayerAddresses[i] != nil {
-                g.sendUDPInput(count, g.GameData.PlayerAddresses[i], playerNumber, true, NoRegID)
+                if redundant { // repeat recent inputs the receiver has not confirmed yet
+                    g.sendUDPInput(g.redundantStart(i, playerNumber, count), g.GameData.PlayerAddresses[i], playerNumber, true, NoRegID)
+                    g.inputPushed(i, playerNumber, count)
+                } else {
+                    g.sendUDPInput(count, g.GameData.PlayerAddresses[i], playerNumber, true, NoRegID)
+                }
             }
         }
     } else if buf[0] == PlayerInputRequest {
@@ -106,6 +112,9 @@ func (g *GameServer) processUDP(addr *net.UDPAddr, buf []byte) {
             g.Logger.Error(err, "could not process request", "regID", regID)
             return
         }
+        if g.redundantInputs() && spectator == 0 {
+            g.inputRequested(sendingPlayerNumber, playerNumber, count)
+        }
         countLag := g.sendUDPInput(count, addr, playerNumber, spectator != 0, sendingPlayerNumber)
         g.GameData.BufferHealth[sendingPlayerNumber] = int32(buf[11])
 
@@ -126,9 +135,13 @@ func (g *GameServer) processUDP(addr *net.UDPAddr, buf []byte) {
             } else if !bytes.Equal(g.GameData.SyncValues[viCount], buf[5:133]) {
                 g.GameDataMutex.Lock() // Status can be modified by ManagePlayers in a different thread
                 g.GameData.Status |= StatusDesync
+                g.desyncVI = viCount
                 g.GameDataMutex.Unlock()
 
-                g.Logger.Error(fmt.Errorf("desync"), "game has desynced", "numPlayers", len(g.Players), "clientSHA", g.ClientSha, "playTime", time.Since(g.StartTime).String(), "emulator", g.Emulator, "features", g.Features)
+                g.Logger.Error(fmt.Errorf("desync"), "game has desynced", "numPlayers", len(g.Players), "clientSHA", g.ClientSha, "playTime", time.Since(g.StartTime).String(), "viCount", viCount, "emulator", g.Emulator, "features", g.Features)
+                if g.OnDesync != nil {
+                    go g.OnDesync(viCount)
+                }
             }
         }
     }
@@ -156,7 +169,7 @@ func (g *GameServer) watchUDP() {
             continue
         }
 
-        g.processUDP(addr, buf)
+        g.handleInput(addr, buf)
     }
 }
 
@@ -190,6 +203,7 @@ func (g *GameServer) createUDPServer() error {
     g.GameData.SyncValues = make(map[uint32][]byte)
     g.GameData.PlayerAlive = make([]bool, 4) //nolint:gomnd
     g.GameData.CountLag = make([]uint32, 4)  //nolint:gomnd
+    g.redundancy = newInputRedundancy()
 
     go g.watchUDP()
     return nil
@@ -0,0 +1,208 @@
+package gameserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultFileExtension = ".sav"
+)
+
+// SaveVault keeps uploaded save files on disk so they can be served to a later room.
+// Saves are keyed by ROM MD5, a group identifier chosen by the host and the save filename,
+// and every upload is kept as a new version until MaxVersions or Retention removes it.
+type SaveVault struct {
+	Dir         string
+	MaxFileSize int64
+	MaxVersions int
+	Retention   time.Duration
+	mutex       sync.Mutex
+}
+
+func (v *SaveVault) fileDir(md5 string, group string, filename string) (string, error) {
+	if len(md5) != 32 || strings.Trim(strings.ToLower(md5), "0123456789abcdef") != "" { //nolint:gomnd,mnd
+		return "", fmt.Errorf("invalid ROM MD5 %q", md5)
+	}
+	if group == "" {
+		return "", fmt.Errorf("save group cannot be empty")
+	}
+	if err := validateFilename(filename); err != nil {
+		return "", err
+	}
+	groupHash := sha256.Sum256([]byte(group))
+	return filepath.Join(v.Dir, strings.ToLower(md5), hex.EncodeToString(groupHash[:8]), filename), nil //nolint:gomnd,mnd
+}
+
+// versions returns the version files in dir, oldest first.
+func (v *SaveVault) versions(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	var versions []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), vaultFileExtension) {
+			versions = append(versions, entry.Name())
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// Store saves data as the newest version of filename and drops versions beyond MaxVersions.
+func (v *SaveVault) Store(md5 string, group string, filename string, data []byte) error {
+	if v.MaxFileSize > 0 && int64(len(data)) > v.MaxFileSize {
+		return fmt.Errorf("save of %d bytes is larger than the vault limit of %d", len(data), v.MaxFileSize)
+	}
+	dir, err := v.fileDir(md5, group, filename)
+	if err != nil {
+		return err
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if err := os.MkdirAll(dir, 0o750); err != nil { //nolint:gomnd,mnd
+		return fmt.Errorf("could not create vault directory: %s", err.Error())
+	}
+	// zero padded so that versions sort by name
+	version := fmt.Sprintf("%020d%s", time.Now().UnixNano(), vaultFileExtension)
+	tmpPath := filepath.Join(dir, version+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil { //nolint:gomnd,mnd
+		return fmt.Errorf("could not write save to vault: %s", err.Error())
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, version)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not write save to vault: %s", err.Error())
+	}
+
+	versions, err := v.versions(dir)
+	if err != nil {
+		return fmt.Errorf("could not list vault versions: %s", err.Error())
+	}
+	for v.MaxVersions > 0 && len(versions) > v.MaxVersions {
+		if err := os.Remove(filepath.Join(dir, versions[0])); err != nil {
+			return fmt.Errorf("could not remove old vault version: %s", err.Error())
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// Latest returns the newest version of filename, or nil if the vault has none.
+func (v *SaveVault) Latest(md5 string, group string, filename string) ([]byte, error) {
+	dir, err := v.fileDir(md5, group, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	versions, err := v.versions(dir)
+	if errors.Is(err, os.ErrNotExist) || len(versions) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list vault versions: %s", err.Error())
+	}
+	data, err := os.ReadFile(filepath.Join(dir, versions[len(versions)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("could not read save from vault: %s", err.Error())
+	}
+	return data, nil
+}
+
+// Prune removes versions older than Retention and returns how many were removed.
+func (v *SaveVault) Prune() (int, error) {
+	if v.Retention <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-v.Retention).UnixNano()
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	removed := 0
+	err := filepath.WalkDir(v.Dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), vaultFileExtension) {
+			return nil
+		}
+		created, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), vaultFileExtension), 10, 64)
+		if err != nil || created >= cutoff {
+			return nil //nolint:nilerr // not a version written by the vault
+		}
+		if err := os.Remove(path); err != nil {
+			return err //nolint:wrapcheck
+		}
+		removed++
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, fmt.Errorf("could not prune vault: %s", err.Error())
+	}
+	return removed, nil
+}
+
+// storeInVault keeps a save uploaded to a room that opted into the vault.
+func (g *GameServer) storeInVault(filename string, data []byte) {
+	if g.Vault == nil || g.VaultGroup == "" {
+		return
+	}
+	if err := g.Vault.Store(g.MD5, g.VaultGroup, filename, data); err != nil {
+		g.Logger.Error(err, "could not store save in vault", "filename", filename, "group", g.VaultGroup)
+		return
+	}
+	g.Logger.Info("stored save in vault", "filename", filename, "filesize", len(data), "group", g.VaultGroup)
+}
+
+// vaultCopy returns the vault copy of filename, read once per room so every player gets the same one.
+func (g *GameServer) vaultCopy(filename string) []byte {
+	g.TCPFilesMutex.Lock()
+	data, ok := g.vaultCopies[filename]
+	g.TCPFilesMutex.Unlock()
+	if ok {
+		return data
+	}
+
+	data = g.loadFromVault(filename)
+	if data == nil {
+		return nil
+	}
+	g.TCPFilesMutex.Lock()
+	defer g.TCPFilesMutex.Unlock()
+	if loaded, ok := g.vaultCopies[filename]; ok { // another player got here first
+		return loaded
+	}
+	if g.vaultCopies == nil {
+		g.vaultCopies = make(map[string][]byte)
+	}
+	g.vaultCopies[filename] = data
+	return data
+}
+
+// loadFromVault returns the vault copy of filename for a room that opted into the vault, or nil.
+func (g *GameServer) loadFromVault(filename string) []byte {
+	if g.Vault == nil || g.VaultGroup == "" {
+		return nil
+	}
+	data, err := g.Vault.Latest(g.MD5, g.VaultGroup, filename)
+	if err != nil {
+		g.Logger.Error(err, "could not load save from vault", "filename", filename, "group", g.VaultGroup)
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,68 @@
+package lobbyserver
+
+import (
+	gameserver "github.com/simple64/mpn-server/internal/gameServer"
+	matchhistory "github.com/simple64/mpn-server/internal/matchHistory"
+)
+
+// recordMatch adds a finished game to the match history, if the server keeps one.
+func (s *LobbyServer) recordMatch(roomName string, g *gameserver.GameServer, summary gameserver.GameSummary) {
+	if s.History == nil {
+		return
+	}
+	match := matchhistory.Match{
+		Room:      roomName,
+		GameName:  g.GameName,
+		MD5:       g.MD5,
+		Emulator:  g.Emulator,
+		ClientSha: g.ClientSha,
+		Features:  g.Features,
+		Start:     g.StateTime(gameserver.StateStarting),
+		End:       g.StateTime(gameserver.StateEnded),
+		Desync:    summary.Desync,
+		DesyncVI:  summary.DesyncVI,
+	}
+	for _, v := range summary.Players {
+		match.Players = append(match.Players, matchhistory.MatchPlayer{
+			Name:            v.Name,
+			Slot:            v.Slot,
+			Disconnect:      v.Disconnect,
+			AvgCountLag:     v.AvgCountLag,
+			AvgBufferHealth: v.AvgBufferHealth,
+		})
+	}
+	if err := s.History.Record(&match); err != nil {
+		s.Logger.Error(err, "could not record match", "room", roomName)
+	}
+}
+
+// setStatsOptOut keeps a player out of stats and leaderboards, or lets them back in. owned is set
+// when the socket asking created or joined a room with that name, nobody else may change it.
+func (s *LobbyServer) setStatsOptOut(receivedMessage SocketMessage, owned bool) SocketMessage {
+	sendMessage := SocketMessage{
+		Type:        TypeReplyStatsOptOut,
+		PlayerName:  receivedMessage.PlayerName,
+		StatsOptOut: receivedMessage.StatsOptOut,
+	}
+	switch {
+	case s.History == nil:
+		sendMessage.Accept = Other
+		sendMessage.Message = "This server does not keep player stats"
+	case receivedMessage.PlayerName == "":
+		sendMessage.Accept = BadName
+		sendMessage.Message = "Player name cannot be empty"
+	case !owned:
+		sendMessage.Accept = NotAllowed
+		sendMessage.Message = "You can only change the stats opt out of a name you play as"
+	default:
+		if err := s.History.SetOptOut(receivedMessage.PlayerName, receivedMessage.StatsOptOut); err != nil {
+			s.Logger.Error(err, "could not change stats opt out", "player", receivedMessage.PlayerName)
+			sendMessage.Accept = Other
+			sendMessage.Message = "Could not change stats opt out"
+		} else {
+			s.Logger.Info("changed stats opt out", "player", receivedMessage.PlayerName, "optOut", receivedMessage.StatsOptOut)
+			sendMessage.Accept = Accepted
+		}
+	}
+	return sendMessage
+}
@@ -0,0 +1,157 @@
+package lobbyserver
+
+import (
+	"net"
+
+	gameserver "github.com/simple64/mpn-server/internal/gameServer"
+	"golang.org/x/net/websocket"
+)
+
+// removePlayer takes playerName out of the room. If they were the host, the player in the lowest
+// slot takes over, so the room keeps someone who can start it. Callers still need to tell the
+// players and watchers with updatePlayers and roomChanged.
+func (s *LobbyServer) removePlayer(g *gameserver.GameServer, playerName string) {
+	g.PlayersMutex.Lock() // any player can modify this, which would be in a different thread
+	delete(g.Players, playerName)
+	for name, v := range g.Players {
+		if v.SwapWith == playerName { // nobody left to answer the request
+			v.SwapWith = ""
+			g.Players[name] = v
+		}
+	}
+	if playerName == g.PlayerName {
+		newHost := ""
+		for name, v := range g.Players {
+			if newHost == "" || v.Number < g.Players[newHost].Number {
+				newHost = name
+			}
+		}
+		if newHost != "" {
+			g.PlayerName = newHost
+			g.Logger.Info("host left, transferred host", "from", playerName, "to", newHost)
+		}
+	}
+	g.PlayersMutex.Unlock()
+	g.NotifyPlayersChanged()
+}
+
+// isBanned reports whether a player with this name or IP was banned from the room.
+func isBanned(g *gameserver.GameServer, playerName string, ip string) bool {
+	g.PlayersMutex.Lock() // the host's socket bans players, joins are checked on others
+	defer g.PlayersMutex.Unlock()
+	for name, bannedIP := range g.BannedPlayers {
+		if name == playerName || (ip != "" && bannedIP == ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// roomLocked reports whether the host closed the room to new players.
+func roomLocked(g *gameserver.GameServer) bool {
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	return g.Locked
+}
+
+func hostReplyType(requestType string) string {
+	switch requestType {
+	case TypeRequestKickPlayer:
+		return TypeReplyKickPlayer
+	case TypeRequestBanPlayer:
+		return TypeReplyBanPlayer
+	case TypeRequestLockRoom:
+		return TypeReplyLockRoom
+	default:
+		return TypeReplyTransferHost
+	}
+}
+
+// handleHostCommand lets the host of the room in receivedMessage kick or ban a player in the
+// lobby, lock the room against new players, or hand the host to another player.
+func (s *LobbyServer) handleHostCommand(ws *websocket.Conn, receivedMessage SocketMessage) SocketMessage {
+	sendMessage := SocketMessage{
+		Type:         hostReplyType(receivedMessage.Type),
+		Port:         receivedMessage.Port,
+		TargetPlayer: receivedMessage.TargetPlayer,
+	}
+	roomName, g := s.findGameServer(receivedMessage.Port)
+	if g == nil {
+		sendMessage.Accept = RoomDeleted
+		sendMessage.Message = "room has been deleted"
+		return sendMessage
+	}
+	sendMessage.RoomName = roomName
+	if !s.isHost(g, ws) {
+		sendMessage.Accept = NotHost
+		sendMessage.Message = "Only the host can do this"
+		return sendMessage
+	}
+
+	if receivedMessage.Type == TypeRequestLockRoom {
+		g.PlayersMutex.Lock() // Locked and PlayerName are guarded like the players they decide about
+		g.Locked = receivedMessage.Locked
+		g.PlayersMutex.Unlock()
+		s.Logger.Info("room lock changed", "room", roomName, "locked", receivedMessage.Locked)
+		sendMessage.Accept = Accepted
+		sendMessage.Locked = receivedMessage.Locked
+		s.updatePlayers(g)
+		s.roomChanged(roomName, g)
+		return sendMessage
+	}
+
+	g.PlayersMutex.Lock()
+	target, ok := g.Players[receivedMessage.TargetPlayer]
+	isHost := receivedMessage.TargetPlayer == g.PlayerName
+	transfer := ok && !isHost && receivedMessage.Type == TypeRequestTransferHost
+	if transfer {
+		g.PlayerName = receivedMessage.TargetPlayer
+	}
+	g.PlayersMutex.Unlock()
+	switch {
+	case !ok:
+		sendMessage.Accept = BadName
+		sendMessage.Message = "Player is not in this room"
+		return sendMessage
+	case isHost:
+		sendMessage.Accept = BadName
+		sendMessage.Message = "You are already the host"
+		return sendMessage
+	case transfer:
+		s.Logger.Info("transferred host", "room", roomName, "host", receivedMessage.TargetPlayer)
+		sendMessage.Accept = Accepted
+		s.updatePlayers(g)
+		s.roomChanged(roomName, g)
+		return sendMessage
+	case g.State() != gameserver.StateLobby:
+		sendMessage.Accept = Other
+		sendMessage.Message = "Players can only be removed before the game starts"
+		return sendMessage
+	}
+
+	reason := "You were kicked from the room"
+	if receivedMessage.Type == TypeRequestBanPlayer {
+		ip, _, err := net.SplitHostPort(target.Socket.Request().RemoteAddr)
+		if err != nil {
+			s.Logger.Error(err, "could not parse IP", "IP", target.Socket.Request().RemoteAddr)
+		}
+		g.PlayersMutex.Lock()
+		if g.BannedPlayers == nil {
+			g.BannedPlayers = make(map[string]string)
+		}
+		g.BannedPlayers[receivedMessage.TargetPlayer] = ip
+		g.PlayersMutex.Unlock()
+		reason = "You were banned from the room"
+	}
+	s.removePlayer(g, receivedMessage.TargetPlayer)
+	s.Logger.Info("removed player from room", "room", roomName, "player", receivedMessage.TargetPlayer, "banned", receivedMessage.Type == TypeRequestBanPlayer)
+
+	kickMessage := SocketMessage{Type: TypeReplyKicked, RoomName: roomName, Port: g.Port, Message: reason}
+	if err := s.sendData(target.Socket, kickMessage); err != nil {
+		s.Logger.Error(err, "failed to send message", "message", kickMessage, "address", target.Socket.Request().RemoteAddr)
+	}
+	s.updatePlayers(g)
+	s.roomChanged(roomName, g)
+	sendMessage.Accept = Accepted
+	return sendMessage
+}
@@ -0,0 +1,169 @@
+package lobbyserver
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	gameserver "github.com/simple64/mpn-server/internal/gameServer"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	DefaultInviteTTL = time.Hour
+	MaxInviteTTL     = 24 * time.Hour
+	maxRoomInvites   = 10
+	inviteCodeLength = 6
+	// no 0/O or 1/I, so codes can be read out loud; 32 letters keep every one equally likely
+	inviteAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+type invite struct {
+	expires time.Time
+	port    int
+}
+
+// roomInvites are the invite codes of every room.
+type roomInvites struct {
+	codes map[string]invite
+	mutex sync.Mutex
+}
+
+func newInviteCode() (string, error) {
+	buf := make([]byte, inviteCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate invite code: %s", err.Error())
+	}
+	for i, v := range buf {
+		buf[i] = inviteAlphabet[int(v)%len(inviteAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// pruneInvites drops expired codes. The caller must hold the mutex.
+func (s *LobbyServer) pruneInvites() {
+	now := time.Now()
+	for code, v := range s.invites.codes {
+		if now.After(v.expires) {
+			delete(s.invites.codes, code)
+		}
+	}
+}
+
+// createInvite returns a new code for the room on port, valid for ttl.
+func (s *LobbyServer) createInvite(port int, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+	if ttl > MaxInviteTTL {
+		ttl = MaxInviteTTL
+	}
+
+	s.invites.mutex.Lock()
+	defer s.invites.mutex.Unlock()
+	if s.invites.codes == nil {
+		s.invites.codes = make(map[string]invite)
+	}
+	s.pruneInvites()
+	count := 0
+	for _, v := range s.invites.codes {
+		if v.port == port {
+			count++
+		}
+	}
+	if count >= maxRoomInvites {
+		return "", time.Time{}, fmt.Errorf("room already has %d invite codes", count)
+	}
+	for {
+		code, err := newInviteCode()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if _, exists := s.invites.codes[code]; exists {
+			continue
+		}
+		expires := time.Now().Add(ttl)
+		s.invites.codes[code] = invite{expires: expires, port: port}
+		return code, expires, nil
+	}
+}
+
+// revokeInvites removes code from the room on port, or all of the room's codes if code is empty.
+// It returns how many were removed.
+func (s *LobbyServer) revokeInvites(port int, code string) int {
+	s.invites.mutex.Lock()
+	defer s.invites.mutex.Unlock()
+	removed := 0
+	for k, v := range s.invites.codes {
+		if v.port == port && (code == "" || strings.EqualFold(code, k)) {
+			delete(s.invites.codes, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+// resolveInvite finds the room an invite code leads to. Codes only lead into rooms still in the lobby.
+func (s *LobbyServer) resolveInvite(code string) (string, *gameserver.GameServer) {
+	s.invites.mutex.Lock()
+	v, ok := s.invites.codes[strings.ToUpper(strings.TrimSpace(code))]
+	s.invites.mutex.Unlock()
+	if !ok || time.Now().After(v.expires) {
+		return "", nil
+	}
+	roomName, g := s.findGameServer(v.port)
+	if g == nil || g.State() != gameserver.StateLobby {
+		return "", nil
+	}
+	return roomName, g
+}
+
+// handleInvite creates or revokes invite codes for the host of the room in receivedMessage.
+func (s *LobbyServer) handleInvite(ws *websocket.Conn, receivedMessage SocketMessage) SocketMessage {
+	sendMessage := SocketMessage{Port: receivedMessage.Port}
+	if receivedMessage.Type == TypeRequestCreateInvite {
+		sendMessage.Type = TypeReplyCreateInvite
+	} else {
+		sendMessage.Type = TypeReplyRevokeInvite
+	}
+
+	roomName, g := s.findGameServer(receivedMessage.Port)
+	switch {
+	case g == nil:
+		sendMessage.Accept = RoomDeleted
+		sendMessage.Message = "room has been deleted"
+	case !s.isHost(g, ws):
+		sendMessage.Accept = NotHost
+		sendMessage.Message = "Only the host can manage invite codes"
+	case receivedMessage.Type == TypeRequestCreateInvite && g.State() != gameserver.StateLobby:
+		sendMessage.Accept = Other
+		sendMessage.Message = "Invite codes can only be created before the game starts"
+	case receivedMessage.Type == TypeRequestCreateInvite:
+		code, expires, err := s.createInvite(g.Port, time.Duration(receivedMessage.InviteTTL)*time.Second)
+		if err != nil {
+			s.Logger.Error(err, "could not create invite code", "room", roomName)
+			sendMessage.Accept = Other
+			sendMessage.Message = err.Error()
+			break
+		}
+		s.Logger.Info("created invite code", "room", roomName, "expires", expires.Format(time.RFC3339))
+		sendMessage.Accept = Accepted
+		sendMessage.RoomName = roomName
+		sendMessage.InviteCode = code
+		sendMessage.InviteExpires = expires.UTC().Format(time.RFC3339)
+	default:
+		removed := s.revokeInvites(g.Port, receivedMessage.InviteCode)
+		if removed == 0 && receivedMessage.InviteCode != "" {
+			sendMessage.Accept = BadInvite
+			sendMessage.Message = "Invite code not found"
+			break
+		}
+		s.Logger.Info("revoked invite codes", "room", roomName, "count", removed)
+		sendMessage.Accept = Accepted
+		sendMessage.RoomName = roomName
+		sendMessage.InviteCode = receivedMessage.InviteCode
+	}
+	return sendMessage
+}
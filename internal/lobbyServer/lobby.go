@@ -14,11 +14,13 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
-	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	gameserver "github.com/simple64/mpn-server/internal/gameServer"
+	matchhistory "github.com/simple64/mpn-server/internal/matchHistory"
+	"github.com/simple64/mpn-server/internal/notifier"
 	"golang.org/x/net/websocket"
 )
 
@@ -33,6 +35,14 @@ const (
 	BadEmulator     = 7
 	BadAuth         = 8
 	Other           = 9
+	DataMismatch    = 10
+	NotHost         = 11
+	BadInvite       = 12
+	RoomLocked      = 13
+	Banned          = 14
+	NotReady        = 15
+	SlotTaken       = 16
+	NotAllowed      = 17
 )
 
 const (
@@ -52,10 +62,50 @@ const (
 	TypeReplyMotd           = "reply_motd"
 	TypeRequestVersion      = "request_version"
 	TypeReplyVersion        = "reply_version"
+	TypeRequestDataHashes   = "request_data_hashes"
+	TypeReplyDataMismatch   = "reply_data_mismatch"
+	TypeReplyTransfer       = "reply_transfer_progress"
+	TypeReplyGameEnded      = "reply_game_ended"
+	TypeRequestStatsOptOut  = "request_stats_opt_out"
+	TypeReplyStatsOptOut    = "reply_stats_opt_out"
+
+	TypeRequestSubscribeRooms   = "request_subscribe_rooms"
+	TypeReplySubscribeRooms     = "reply_subscribe_rooms"
+	TypeReplyRoomsEnd           = "reply_rooms_end"
+	TypeReplyRoomAdded          = "reply_room_added"
+	TypeReplyRoomUpdated        = "reply_room_updated"
+	TypeReplyRoomRemoved        = "reply_room_removed"
+	TypeRequestUnsubscribeRooms = "request_unsubscribe_rooms"
+	TypeRequestCreateInvite     = "request_create_invite"
+	TypeReplyCreateInvite       = "reply_create_invite"
+	TypeRequestRevokeInvite     = "request_revoke_invite"
+	TypeReplyRevokeInvite       = "reply_revoke_invite"
+	TypeRequestKickPlayer       = "request_kick_player"
+	TypeReplyKickPlayer         = "reply_kick_player"
+	TypeRequestBanPlayer        = "request_ban_player"
+	TypeReplyBanPlayer          = "reply_ban_player"
+	TypeRequestLockRoom         = "request_lock_room"
+	TypeReplyLockRoom           = "reply_lock_room"
+	TypeRequestTransferHost     = "request_transfer_host"
+	TypeReplyTransferHost       = "reply_transfer_host"
+	TypeReplyKicked             = "reply_kicked"
+	TypeRequestReady            = "request_ready"
+	TypeRequestStartRules       = "request_start_rules"
+	TypeReplyStartRules         = "reply_start_rules"
+	TypeReplyStartCountdown     = "reply_start_countdown"
+	TypeRequestCancelStart      = "request_cancel_start"
+	TypeRequestSwapSlots        = "request_swap_slots"
+	TypeReplySwapSlots          = "reply_swap_slots"
+	TypeReplySwapRequest        = "reply_swap_request"
+	TypeRequestDeclineSwap      = "request_decline_swap"
+	TypeReplyDeclineSwap        = "reply_decline_swap"
+	TypeReplySwapDeclined       = "reply_swap_declined"
+	TypeRequestSetSlot          = "request_set_slot"
+	TypeReplySetSlot            = "reply_set_slot"
 )
 
 type LobbyServer struct {
-	GameServers      map[string]*gameserver.GameServer
+	GameServers      map[string]*gameserver.GameServer // only touched under gameServersMutex, use gameServers to range over it
 	Logger           logr.Logger
 	Name             string
 	Motd             string
@@ -64,26 +114,65 @@ type LobbyServer struct {
 	DisableBroadcast bool
 	EnableAuth       bool
 	ActivePorts      []int
+	UploadBudget     *gameserver.UploadBudget
+	SaveVault        *gameserver.SaveVault
+	History          *matchhistory.Store
+	Notifier         *notifier.Dispatcher
+	DisableSTUN      bool
+	STUNAltPort      int
+	rooms            roomSubscribers
+	invites          roomInvites
+	starts           roomStarts
+	gameServersMutex sync.Mutex
 }
 
 type SocketMessage struct {
-	Features       map[string]string `json:"features,omitempty"`
-	GameName       string            `json:"game_name,omitempty"`
-	Protected      bool              `json:"protected"`
-	Password       string            `json:"password"`
-	Message        string            `json:"message,omitempty"`
-	ClientSha      string            `json:"client_sha,omitempty"`
-	Emulator       string            `json:"emulator,omitempty"`
-	PlayerName     string            `json:"player_name"`
-	RoomName       string            `json:"room_name"`
-	MD5            string            `json:"MD5,omitempty"`
-	AuthTime       string            `json:"authTime,omitempty"`
-	Type           string            `json:"type"`
-	Auth           string            `json:"auth,omitempty"`
-	PlayerNames    []string          `json:"player_names,omitempty"`
-	Accept         int               `json:"accept"`
-	NetplayVersion string            `json:"netplay_version,omitempty"`
-	Port           int               `json:"port"`
+	Features       map[string]string       `json:"features,omitempty"`
+	GameSummary    *gameserver.GameSummary `json:"game_summary,omitempty"`
+	StartRules     *StartRules             `json:"start_rules,omitempty"`
+	Filter         *RoomFilter             `json:"filter,omitempty"`
+	DataHashes     map[string]string       `json:"data_hashes,omitempty"`
+	GameName       string                  `json:"game_name,omitempty"`
+	Protected      bool                    `json:"protected"`
+	Password       string                  `json:"password"`
+	Message        string                  `json:"message,omitempty"`
+	ClientSha      string                  `json:"client_sha,omitempty"`
+	Emulator       string                  `json:"emulator,omitempty"`
+	PlayerName     string                  `json:"player_name"`
+	RoomName       string                  `json:"room_name"`
+	MD5            string                  `json:"MD5,omitempty"`
+	AuthTime       string                  `json:"authTime,omitempty"`
+	Type           string                  `json:"type"`
+	Auth           string                  `json:"auth,omitempty"`
+	PlayerNames    []string                `json:"player_names,omitempty"`
+	Accept         int                     `json:"accept"`
+	NetplayVersion string                  `json:"netplay_version,omitempty"`
+	SaveGroup      string                  `json:"save_group,omitempty"`
+	VaultSaves     bool                    `json:"vault_saves,omitempty"` // every player, the host included, loads saves from the vault
+	StrictData     bool                    `json:"strict_data_check,omitempty"`
+	TransferName   string                  `json:"transfer_name,omitempty"`
+	TransferDone   uint32                  `json:"transfer_received,omitempty"`
+	TransferTotal  uint32                  `json:"transfer_total,omitempty"`
+	TransferUpload bool                    `json:"transfer_upload,omitempty"`
+	StatsOptOut    bool                    `json:"stats_opt_out,omitempty"`
+	RoomState      string                  `json:"room_state,omitempty"`
+	PlayerCount    int                     `json:"player_count,omitempty"`
+	SlotsFree      int                     `json:"slots_free"`
+	RoomCount      int                     `json:"room_count,omitempty"`
+	Region         string                  `json:"region,omitempty"`
+	InviteCode     string                  `json:"invite_code,omitempty"`
+	InviteExpires  string                  `json:"invite_expires,omitempty"`
+	InviteTTL      int                     `json:"invite_ttl,omitempty"` // seconds
+	TargetPlayer   string                  `json:"target_player,omitempty"`
+	Host           string                  `json:"host,omitempty"`
+	Locked         bool                    `json:"locked,omitempty"`
+	Ready          bool                    `json:"ready,omitempty"`
+	PlayersReady   []bool                  `json:"players_ready,omitempty"` // by slot, like PlayerNames
+	Countdown      int                     `json:"countdown,omitempty"`     // seconds until the game starts
+	StartAt        int64                   `json:"start_at,omitempty"`      // when the game starts, in Unix milliseconds
+	Slot           *int                    `json:"slot,omitempty"`          // controller slot, counted from 0 like PlayerNames
+	PakPolicy      *gameserver.PakPolicy   `json:"pak_policy,omitempty"`
+	Port           int                     `json:"port"`
 }
 
 const NetplayAPIVersion = "MPN-4"
@@ -124,9 +213,21 @@ func (s *LobbyServer) sendData(ws *websocket.Conn, message SocketMessage) error
 	return nil
 }
 
+// gameServers returns a copy of GameServers, so callers can range over it while other goroutines
+// create and remove rooms. Rooms remove themselves from whichever goroutine ends them.
+func (s *LobbyServer) gameServers() map[string]*gameserver.GameServer {
+	s.gameServersMutex.Lock()
+	defer s.gameServersMutex.Unlock()
+	servers := make(map[string]*gameserver.GameServer, len(s.GameServers))
+	for name, g := range s.GameServers {
+		servers[name] = g
+	}
+	return servers
+}
+
 // this function finds the GameServer pointer based on the port number.
 func (s *LobbyServer) findGameServer(port int) (string, *gameserver.GameServer) {
-	for i, v := range s.GameServers {
+	for i, v := range s.gameServers() {
 		if v.Port == port {
 			return i, v
 		}
@@ -141,77 +242,163 @@ func (s *LobbyServer) updatePlayers(g *gameserver.GameServer) {
 	var sendMessage SocketMessage
 	sendMessage.PlayerNames = make([]string, 4) //nolint:gomnd
 	sendMessage.Type = TypeReplyPlayers
+	sendMessage.PlayersReady = make([]bool, 4) //nolint:gomnd
+	rules := s.startRules(g)
+	sendMessage.StartRules = &rules
+	g.PlayersMutex.Lock()
+	sendMessage.Host = g.PlayerName
+	sendMessage.Locked = g.Locked
 	for i, v := range g.Players {
 		sendMessage.PlayerNames[v.Number] = i
+		sendMessage.PlayersReady[v.Number] = v.Ready
 	}
+	g.PlayersMutex.Unlock()
 
 	// send the updated player list to all connected players
-	for _, v := range g.Players {
-		if err := s.sendData(v.Socket, sendMessage); err != nil {
-			s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", v.Socket.Request().RemoteAddr)
+	s.sendPlayers(g, sendMessage)
+}
+
+// isHost reports whether ws belongs to the room's host.
+func (s *LobbyServer) isHost(g *gameserver.GameServer, ws *websocket.Conn) bool {
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	host, ok := g.Players[g.PlayerName]
+	return ok && host.Socket == ws
+}
+
+// this function finds the name of the player connected on ws.
+func (s *LobbyServer) findPlayer(g *gameserver.GameServer, ws *websocket.Conn) (string, bool) {
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	for i, v := range g.Players {
+		if v.Socket == ws {
+			return i, true
 		}
 	}
+	return "", false
 }
 
-func (s *LobbyServer) publishDiscord(message string, channel string) {
-	body := map[string]string{
-		"content": message,
+// checkRoomData warns every player when someone's loaded data differs from the host's.
+// It returns false if the room requires matching data and the game must not start, which
+// includes a player, the host too, not having reported what they loaded.
+func (s *LobbyServer) checkRoomData(g *gameserver.GameServer) bool {
+	if missing := g.MissingDataHashes(); g.StrictDataCheck && len(missing) > 0 {
+		g.Logger.Info("players did not report their data", "players", missing)
+		s.sendPlayers(g, SocketMessage{
+			Type:        TypeReplyDataMismatch,
+			Accept:      DataMismatch,
+			PlayerNames: missing,
+			Message:     fmt.Sprintf("Cannot start game, the room checks save data and settings but %s did not report theirs", strings.Join(missing, ", ")),
+		})
+		return false
 	}
-	bodyJSON, err := json.Marshal(body)
-	if err != nil {
-		s.Logger.Error(err, "could not read body")
-		return
+
+	mismatches := g.CheckDataHashes()
+	if len(mismatches) == 0 {
+		return true
 	}
-	httpClient := retryablehttp.NewClient()
-	httpClient.Logger = nil
-	httpRequest, err := retryablehttp.NewRequest(http.MethodPost, channel, bodyJSON)
-	if err != nil {
-		s.Logger.Error(err, "could not create request")
+
+	var sendMessage SocketMessage
+	sendMessage.Type = TypeReplyDataMismatch
+	sendMessage.Accept = DataMismatch
+	details := make([]string, 0, len(mismatches))
+	for _, v := range mismatches {
+		sendMessage.PlayerNames = append(sendMessage.PlayerNames, v.Player)
+		details = append(details, fmt.Sprintf("%s (%s)", v.Player, strings.Join(v.Keys, ", ")))
 	}
-	httpRequest.Header.Set("Content-Type", "application/json")
-	httpRequest.Header.Set("User-Agent", "simple64Bot (simple64.github.io, 1)")
-	resp, err := httpClient.Do(httpRequest)
-	if err != nil {
-		s.Logger.Error(err, "could not send request")
-	} else {
-		resp.Body.Close()
+	sendMessage.Message = fmt.Sprintf("Save data or settings differ from the host's, the game will likely desync: %s", strings.Join(details, "; "))
+	if g.StrictDataCheck {
+		sendMessage.Message = fmt.Sprintf("Cannot start game, save data or settings differ from the host's: %s", strings.Join(details, "; "))
 	}
+	g.Logger.Info("player data does not match host", "mismatches", mismatches, "strict", g.StrictDataCheck)
+
+	s.sendPlayers(g, sendMessage)
+	return !g.StrictDataCheck
 }
 
-func (s *LobbyServer) announceDiscord(g *gameserver.GameServer) {
-	roomType := "public"
-	if g.Password != "" {
-		roomType = "private"
+// reconnectPlayer lets a player whose emulator dropped out of a running game take their slot back.
+// Only a connection from the same IP address as the original one may do so.
+func (s *LobbyServer) reconnectPlayer(g *gameserver.GameServer, playerName string, ws *websocket.Conn) bool {
+	ip, _, err := net.SplitHostPort(ws.Request().RemoteAddr)
+	if err != nil {
+		s.Logger.Error(err, "could not parse IP", "IP", ws.Request().RemoteAddr)
+		return false
+	}
+
+	g.PlayersMutex.Lock()
+	client, ok := g.Players[playerName]
+	if !ok || client.IP != ip || client.Socket == ws || !g.CanReconnect(client.Number) {
+		g.PlayersMutex.Unlock()
+		return false
 	}
+	client.Socket = ws
+	g.Players[playerName] = client
+	g.PlayersMutex.Unlock()
 
-	message := fmt.Sprintf("New %s netplay room running in %s has been created! Come play %s", roomType, s.Name, g.GameName)
+	g.BeginReconnect(client.Number)
+	s.Logger.Info("player reconnecting to running game", "player", playerName, "number", client.Number, "port", g.Port, "address", ws.Request().RemoteAddr)
+	return true
+}
 
-	if roomType == "public" {
-		for i := 0; i < 10; i++ {
-			channel := os.Getenv(fmt.Sprintf("%s_CHANNEL_%d", strings.ToUpper(g.Emulator), i))
-			if channel != "" {
-				s.publishDiscord(message, channel)
-			}
-		}
+// relayTransferProgress tells everyone in the room how far a player's chunked save or custom data transfer is.
+func (s *LobbyServer) relayTransferProgress(g *gameserver.GameServer, progress gameserver.TransferProgress) {
+	sendMessage := SocketMessage{
+		Type:           TypeReplyTransfer,
+		PlayerName:     progress.Player,
+		TransferName:   progress.Key,
+		TransferDone:   progress.Received,
+		TransferTotal:  progress.Total,
+		TransferUpload: progress.Upload,
 	}
+	s.sendPlayers(g, sendMessage)
+}
 
-	devChannel := os.Getenv(fmt.Sprintf("%s_DEV_CHANNEL", strings.ToUpper(g.Emulator)))
-	if devChannel != "" {
-		s.publishDiscord(message, devChannel)
+// announceGameEnded sends the summary of a finished game to the players still in the lobby and logs it.
+func (s *LobbyServer) announceGameEnded(g *gameserver.GameServer, summary gameserver.GameSummary) {
+	g.Logger.Info("game ended", "event", TypeReplyGameEnded, "duration", time.Duration(summary.DurationMs)*time.Millisecond, "players", summary.Players, "desync", summary.Desync, "desyncVI", summary.DesyncVI, "emulator", g.Emulator, "features", g.Features)
+
+	sendMessage := SocketMessage{
+		Type:        TypeReplyGameEnded,
+		GameName:    g.GameName,
+		Port:        g.Port,
+		GameSummary: &summary,
 	}
+	s.sendPlayers(g, sendMessage)
 }
 
-func (s *LobbyServer) watchGameServer(name string, g *gameserver.GameServer) {
-	go g.ManageBuffer()
-	go g.ManagePlayers()
-	for {
-		if !g.Running {
-			s.Logger.Info("game server deleted", "room", name, "port", g.Port)
-			delete(s.GameServers, name)
-			return
+// roomStateChanged removes rooms from the lobby once they end, telling the players how the game went.
+func (s *LobbyServer) roomStateChanged(g *gameserver.GameServer, from gameserver.RoomState, to gameserver.RoomState) {
+	var roomName string
+	for name, v := range s.gameServers() {
+		if v == g {
+			roomName = name
 		}
-		time.Sleep(time.Second * 5) //nolint:gomnd
 	}
+	s.publishRoomState(roomName, g, to)
+	if to == gameserver.StateStarting { // nobody new can join anymore
+		s.revokeInvites(g.Port, "")
+	}
+	if to != gameserver.StateEnded {
+		return
+	}
+	if from == gameserver.StateStarting || from == gameserver.StateRunning {
+		summary := g.Summary()
+		s.announceGameEnded(g, summary)
+		s.recordMatch(roomName, g, summary)
+		s.notifyGameEnded(roomName, g, summary)
+	}
+	s.revokeInvites(g.Port, "")
+	s.forgetStart(g)
+	if roomName != "" {
+		s.Logger.Info("game server deleted", "room", roomName, "port", g.Port, "state", from.String())
+		s.gameServersMutex.Lock()
+		delete(s.GameServers, roomName)
+		s.gameServersMutex.Unlock()
+	}
+	if err := g.Transition(gameserver.StateDestroyed); err != nil {
+		s.Logger.Error(err, "could not destroy room", "port", g.Port)
+	}
+	s.closeRoomAnnouncement(g)
 }
 
 func (s *LobbyServer) validateAuth(receivedMessage SocketMessage) bool {
@@ -250,7 +437,9 @@ func (s *LobbyServer) validateAuth(receivedMessage SocketMessage) bool {
 
 func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 	authenticated := false
+	playerNames := make(map[string]bool) // the names this socket created or joined rooms with
 	defer ws.Close()
+	defer s.unsubscribeRooms(ws)
 
 	for {
 		var rawMessage SocketMessage
@@ -258,23 +447,21 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				if errors.Is(err, io.EOF) {
-					for i, v := range s.GameServers {
-						if !v.Running {
+					for i, v := range s.gameServers() {
+						if v.State() == gameserver.StateLobby {
 							for k, w := range v.Players {
 								if w.Socket == ws {
 									s.Logger.Info("Player has left lobby", "player", k, "room", i, "address", ws.Request().RemoteAddr)
 	
-									v.PlayersMutex.Lock() // any player can modify this, which would be in a different thread
-									delete(v.Players, k)
-									v.PlayersMutex.Unlock()
+									s.removePlayer(v, k)
 	
 									s.updatePlayers(v)
+									s.roomChanged(i, v)
 								}
 							}
 							if len(v.Players) == 0 {
 								s.Logger.Info("No more players in lobby, deleting", "room", i)
 								v.CloseServers()
-								delete(s.GameServers, i)
 							}
 						}
 					}
@@ -314,7 +501,9 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 		switch receivedMessage.Type {
 		case TypeRequestCreateRoom:
 			sendMessage.Type = TypeReplyCreateRoom
+			s.gameServersMutex.Lock()
 			_, exists := s.GameServers[receivedMessage.RoomName]
+			s.gameServersMutex.Unlock()
 			if exists {
 				sendMessage.Accept = DuplicateName
 				sendMessage.Message = "Room with this name already exists"
@@ -334,9 +523,26 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 				sendMessage.Accept = BadAuth
 				sendMessage.Message = "Bad authentication code"
 				s.Logger.Info("bad auth code", "message", receivedMessage, "address", ws.Request().RemoteAddr)
+			} else if receivedMessage.PakPolicy != nil && receivedMessage.PakPolicy.Validate() != nil {
+				sendMessage.Accept = Other
+				sendMessage.Message = receivedMessage.PakPolicy.Validate().Error()
 			} else {
 				authenticated = true
-				g := gameserver.GameServer{}
+				g := gameserver.GameServer{Budget: s.UploadBudget}
+				g.OnTransferProgress = func(progress gameserver.TransferProgress) {
+					s.relayTransferProgress(&g, progress)
+				}
+				roomName := receivedMessage.RoomName
+				g.OnDesync = func(viCount uint32) {
+					event := s.roomEvent(notifier.EventDesync, roomName, &g)
+					event.DesyncVI = viCount
+					s.notify(event)
+				}
+				if s.SaveVault != nil && receivedMessage.SaveGroup != "" {
+					g.Vault = s.SaveVault
+					g.VaultGroup = receivedMessage.SaveGroup
+					g.VaultSaves = receivedMessage.VaultSaves
+				}
 				sendMessage.Port = g.CreateNetworkServers(s.BasePort, s.MaxGames, receivedMessage.RoomName, receivedMessage.GameName, receivedMessage.PlayerName, s.Logger)
 				if sendMessage.Port == 0 {
 					sendMessage.Accept = Other
@@ -351,6 +557,12 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 					g.Players = make(map[string]gameserver.Client)
 					g.Features = receivedMessage.Features
 					g.PlayerName = receivedMessage.PlayerName
+					g.StrictDataCheck = receivedMessage.StrictData
+					g.Region = receivedMessage.Region
+					g.PakPolicy = gameserver.DefaultPakPolicy()
+					if receivedMessage.PakPolicy != nil {
+						g.PakPolicy = *receivedMessage.PakPolicy
+					}
 					ip, _, err := net.SplitHostPort(ws.Request().RemoteAddr)
 					if err != nil {
 						s.Logger.Error(err, "could not parse IP", "IP", ws.Request().RemoteAddr)
@@ -360,14 +572,24 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 						Number: 0,
 						Socket: ws,
 					}
+					g.OnStateChange(s.roomStateChanged)
+					s.gameServersMutex.Lock()
 					s.GameServers[receivedMessage.RoomName] = &g
+					s.gameServersMutex.Unlock()
+					if err := g.Transition(gameserver.StateLobby); err != nil {
+						s.Logger.Error(err, "could not open room", "room", receivedMessage.RoomName)
+					}
 					s.Logger.Info("Created new room", "room", receivedMessage.RoomName, "port", g.Port, "game", g.GameName, "creator", receivedMessage.PlayerName, "clientSHA", receivedMessage.ClientSha, "creatorIP", ws.Request().RemoteAddr, "emulator", receivedMessage.Emulator, "features", receivedMessage.Features)
 					sendMessage.Accept = Accepted
 					sendMessage.RoomName = receivedMessage.RoomName
 					sendMessage.GameName = g.GameName
 					sendMessage.PlayerName = receivedMessage.PlayerName
 					sendMessage.Features = receivedMessage.Features
-					s.announceDiscord(&g)
+					sendMessage.SaveGroup = g.VaultGroup
+					sendMessage.VaultSaves = g.VaultSaves
+					sendMessage.PakPolicy = &g.PakPolicy
+					playerNames[receivedMessage.PlayerName] = true
+					s.notify(s.roomEvent(notifier.EventRoomCreated, receivedMessage.RoomName, &g))
 				}
 			}
 			if err := s.sendData(ws, sendMessage); err != nil {
@@ -388,43 +610,86 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 				s.Logger.Info("bad auth code", "message", receivedMessage, "address", ws.Request().RemoteAddr)
 			} else {
 				authenticated = true
-				for i, v := range s.GameServers {
-					if v.Running {
-						continue
+				rooms, total, err := s.findRooms(receivedMessage.Emulator, receivedMessage.Filter)
+				if err != nil {
+					sendMessage.Accept = Other
+					sendMessage.Message = err.Error()
+					if err := s.sendData(ws, sendMessage); err != nil {
+						s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
 					}
-					if receivedMessage.Emulator != v.Emulator {
-						continue
+					continue
+				}
+				for _, v := range rooms {
+					sendMessage = s.roomInfo(TypeReplyGetRooms, v.name, v.g)
+					if err := s.sendData(ws, sendMessage); err != nil {
+						s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
 					}
-					sendMessage.Protected = v.Password != ""
-					sendMessage.Accept = Accepted
-					sendMessage.RoomName = i
-					sendMessage.MD5 = v.MD5
-					sendMessage.Port = v.Port
-					sendMessage.GameName = v.GameName
-					sendMessage.Features = v.Features
-					sendMessage.PlayerName = v.PlayerName
+				}
+				if receivedMessage.Filter != nil { // clients that ask for a page also get to know where the list ends
+					sendMessage = SocketMessage{Type: TypeReplyRoomsEnd, Accept: Accepted, RoomCount: total}
 					if err := s.sendData(ws, sendMessage); err != nil {
 						s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
 					}
 				}
 			}
+		case TypeRequestSubscribeRooms:
+			sendMessage.Type = TypeReplySubscribeRooms
+			if receivedMessage.NetplayVersion != NetplayAPIVersion {
+				sendMessage.Accept = MismatchVersion
+				sendMessage.Message = "Client and server not at same API version. Please update your emulator"
+			} else if receivedMessage.Emulator == "" {
+				sendMessage.Accept = BadEmulator
+				sendMessage.Message = "Emulator name cannot be empty"
+			} else if !s.validateAuth(receivedMessage) {
+				sendMessage.Accept = BadAuth
+				sendMessage.Message = "Bad authentication code"
+				s.Logger.Info("bad auth code", "message", receivedMessage, "address", ws.Request().RemoteAddr)
+			} else {
+				authenticated = true
+				s.subscribeRooms(ws, receivedMessage.Emulator)
+				continue
+			}
+			if err := s.sendData(ws, sendMessage); err != nil {
+				s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+			}
+
+		case TypeRequestUnsubscribeRooms:
+			s.unsubscribeRooms(ws)
+
 		case TypeRequestJoinRoom:
 			if !authenticated {
 				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to join room without being authenticated", "address", ws.Request().RemoteAddr)
 				continue
 			}
 			var duplicateName bool
+			var reconnected bool
 			var accepted int
 			var message string
 			sendMessage.Type = TypeReplyJoinRoom
 			roomName, g := s.findGameServer(receivedMessage.Port)
-			if g != nil {
+			invited := false
+			if receivedMessage.InviteCode != "" { // the code stands in for the port and the password
+				roomName, g = s.resolveInvite(receivedMessage.InviteCode)
+				invited = g != nil
+			}
+			ip, _, err := net.SplitHostPort(ws.Request().RemoteAddr)
+			if err != nil {
+				s.Logger.Error(err, "could not parse IP", "IP", ws.Request().RemoteAddr)
+			}
+			if g == nil && receivedMessage.InviteCode != "" {
+				accepted = BadInvite
+				message = "Invite code is invalid or has expired"
+				s.Logger.Info("bad invite code", "message", receivedMessage, "address", ws.Request().RemoteAddr)
+			} else if g != nil {
 				for i := range g.Players {
 					if receivedMessage.PlayerName == i {
 						duplicateName = true
 					}
 				}
-				if g.Password != "" && g.Password != receivedMessage.Password {
+				if isBanned(g, receivedMessage.PlayerName, ip) {
+					accepted = Banned
+					message = "You are banned from this room"
+				} else if g.Password != "" && g.Password != receivedMessage.Password && !invited {
 					accepted = BadPassword
 					message = "Incorrect password"
 				} else if g.ClientSha != receivedMessage.ClientSha {
@@ -433,6 +698,24 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 				} else if g.MD5 != receivedMessage.MD5 {
 					accepted = MismatchVersion
 					message = "ROM does not match room ROM"
+				} else if g.InGame() && duplicateName {
+					if s.reconnectPlayer(g, receivedMessage.PlayerName, ws) {
+						reconnected = true
+						sendMessage.RoomName = roomName
+						sendMessage.GameName = g.GameName
+						sendMessage.PlayerName = receivedMessage.PlayerName
+						sendMessage.Features = g.Features
+						sendMessage.Port = g.Port
+					} else {
+						accepted = DuplicateName
+						message = "Player name already in use"
+					}
+				} else if g.State() != gameserver.StateLobby { // only the players the game started with may come back
+					accepted = Other
+					message = "Game has already started"
+				} else if roomLocked(g) {
+					accepted = RoomLocked
+					message = "Room is locked"
 				} else if len(g.Players) >= 4 {
 					accepted = RoomFull
 					message = "Room is full"
@@ -442,31 +725,12 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 				} else if duplicateName {
 					accepted = DuplicateName
 					message = "Player name already in use"
+				} else if number, code, reason := assignSlot(g, receivedMessage.Slot, receivedMessage.PlayerName, gameserver.Client{IP: ip, Socket: ws}); code != Accepted {
+					accepted = code
+					message = reason
 				} else {
-					var number int
-					for number = 0; number < 4; number++ {
-						goodNumber := true
-						for _, v := range g.Players {
-							if v.Number == number {
-								goodNumber = false
-							}
-						}
-						if goodNumber {
-							break
-						}
-					}
-
-					ip, _, err := net.SplitHostPort(ws.Request().RemoteAddr)
-					if err != nil {
-						s.Logger.Error(err, "could not parse IP", "IP", ws.Request().RemoteAddr)
-					}
-					g.PlayersMutex.Lock()
-					g.Players[receivedMessage.PlayerName] = gameserver.Client{
-						IP:     ip,
-						Socket: ws,
-						Number: number,
-					}
-					g.PlayersMutex.Unlock()
+					g.NotifyPlayersChanged()
+					s.roomChanged(roomName, g)
 
 					s.Logger.Info("new player joining room", "player", receivedMessage.PlayerName, "playerIP", ws.Request().RemoteAddr, "room", roomName, "number", number)
 					sendMessage.RoomName = roomName
@@ -480,11 +744,50 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 				message = "room has been deleted"
 				s.Logger.Info("server not found (room deleted)", "message", receivedMessage, "address", ws.Request().RemoteAddr)
 			}
+			if accepted == Accepted {
+				playerNames[receivedMessage.PlayerName] = true
+			}
 			sendMessage.Accept = accepted
 			sendMessage.Message = message
 			if err := s.sendData(ws, sendMessage); err != nil {
 				s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
 			}
+			if reconnected { // the game is already running, so start the emulator right away
+				beginMessage := SocketMessage{Type: TypeReplyBeginGame, Port: g.Port}
+				if err := s.sendData(ws, beginMessage); err != nil {
+					s.Logger.Error(err, "failed to send message", "message", beginMessage, "address", ws.Request().RemoteAddr)
+				}
+			}
+
+		case TypeRequestCreateInvite, TypeRequestRevokeInvite:
+			if !authenticated {
+				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to manage invite codes without being authenticated", "address", ws.Request().RemoteAddr)
+				continue
+			}
+			sendMessage = s.handleInvite(ws, receivedMessage)
+			if err := s.sendData(ws, sendMessage); err != nil {
+				s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+			}
+
+		case TypeRequestKickPlayer, TypeRequestBanPlayer, TypeRequestLockRoom, TypeRequestTransferHost:
+			if !authenticated {
+				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to use host controls without being authenticated", "address", ws.Request().RemoteAddr)
+				continue
+			}
+			sendMessage = s.handleHostCommand(ws, receivedMessage)
+			if err := s.sendData(ws, sendMessage); err != nil {
+				s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+			}
+
+		case TypeRequestSwapSlots, TypeRequestDeclineSwap, TypeRequestSetSlot:
+			if !authenticated {
+				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to change slots without being authenticated", "address", ws.Request().RemoteAddr)
+				continue
+			}
+			sendMessage = s.handleSlotRequest(ws, receivedMessage)
+			if err := s.sendData(ws, sendMessage); err != nil {
+				s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+			}
 
 		case TypeRequestPlayers:
 			if !authenticated {
@@ -521,22 +824,51 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to begin game without being authenticated", "address", ws.Request().RemoteAddr)
 				continue
 			}
-			sendMessage.Type = TypeReplyBeginGame
-			roomName, g := s.findGameServer(receivedMessage.Port)
+			if refusal := s.requestStart(ws, receivedMessage); refusal != nil {
+				if err := s.sendData(ws, *refusal); err != nil {
+					s.Logger.Error(err, "failed to send message", "message", *refusal, "address", ws.Request().RemoteAddr)
+				}
+			}
+
+		case TypeRequestCancelStart:
+			if !authenticated {
+				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to stop the countdown without being authenticated", "address", ws.Request().RemoteAddr)
+				continue
+			}
+			if refusal := s.cancelStart(ws, receivedMessage); refusal != nil {
+				if err := s.sendData(ws, *refusal); err != nil {
+					s.Logger.Error(err, "failed to send message", "message", *refusal, "address", ws.Request().RemoteAddr)
+				}
+			}
+
+		case TypeRequestReady:
+			if !authenticated {
+				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to change ready without being authenticated", "address", ws.Request().RemoteAddr)
+				continue
+			}
+			s.setReady(ws, receivedMessage)
+
+		case TypeRequestStartRules:
+			if !authenticated {
+				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to change start rules without being authenticated", "address", ws.Request().RemoteAddr)
+				continue
+			}
+			sendMessage = s.setStartRules(ws, receivedMessage)
+			if err := s.sendData(ws, sendMessage); err != nil {
+				s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+			}
+
+		case TypeRequestDataHashes:
+			if !authenticated {
+				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to report data hashes without being authenticated", "address", ws.Request().RemoteAddr)
+				continue
+			}
+			_, g := s.findGameServer(receivedMessage.Port)
 			if g != nil {
-				if g.Running {
-					s.Logger.Error(fmt.Errorf("game already running"), "game running", "message", receivedMessage, "address", ws.Request().RemoteAddr)
+				if playerName, ok := s.findPlayer(g, ws); ok {
+					g.SetDataHashes(playerName, receivedMessage.DataHashes)
 				} else {
-					g.Running = true
-					g.StartTime = time.Now()
-					g.Logger.Info("starting game", "time", g.StartTime.Format(time.RFC3339))
-					go s.watchGameServer(roomName, g)
-					sendMessage.Port = g.Port
-					for _, v := range g.Players {
-						if err := s.sendData(v.Socket, sendMessage); err != nil {
-							s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
-						}
-					}
+					s.Logger.Error(fmt.Errorf("player not in room"), "could not record data hashes", "message", receivedMessage, "address", ws.Request().RemoteAddr)
 				}
 			} else {
 				s.Logger.Error(fmt.Errorf("could not find game server"), "server not found", "message", receivedMessage, "address", ws.Request().RemoteAddr)
@@ -553,6 +885,16 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 				s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
 			}
 
+		case TypeRequestStatsOptOut:
+			if !authenticated {
+				s.Logger.Error(fmt.Errorf("bad auth"), "User tried to change stats opt out without being authenticated", "address", ws.Request().RemoteAddr)
+				continue
+			}
+			sendMessage = s.setStatsOptOut(receivedMessage, playerNames[receivedMessage.PlayerName])
+			if err := s.sendData(ws, sendMessage); err != nil {
+				s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+			}
+
 		case TypeRequestVersion:
 			sendMessage.Type = TypeReplyVersion
 			sendMessage.Message = getVersion()
@@ -566,6 +908,23 @@ func (s *LobbyServer) wsHandler(ws *websocket.Conn) {
 	}
 }
 
+// inputHandler tunnels game input for the room on the "port" query parameter, for players whose network blocks UDP.
+func (s *LobbyServer) inputHandler(ws *websocket.Conn) {
+	port, err := strconv.Atoi(ws.Request().URL.Query().Get("port"))
+	if err != nil {
+		s.Logger.Error(err, "bad port for input tunnel", "address", ws.Request().RemoteAddr)
+		ws.Close()
+		return
+	}
+	_, g := s.findGameServer(port)
+	if g == nil {
+		s.Logger.Error(fmt.Errorf("could not find game server"), "server not found for input tunnel", "port", port, "address", ws.Request().RemoteAddr)
+		ws.Close()
+		return
+	}
+	g.ServeInputTunnel(ws)
+}
+
 // this function figures out what is our outgoing IP address.
 func (s *LobbyServer) getOutboundIP(dest *net.UDPAddr) (net.IP, error) {
 	conn, err := net.DialUDP("udp", nil, dest)
@@ -607,6 +966,7 @@ func (s *LobbyServer) processBroadcast(udpServer *net.UDPConn, addr *net.UDPAddr
 	}
 }
 
+// runBroadcastServer answers LAN discovery broadcasts and STUN binding requests, which share the port.
 func (s *LobbyServer) runBroadcastServer(broadcastPort int) {
 	broadcastServer, err := net.ListenUDP("udp", &net.UDPAddr{Port: broadcastPort})
 	if err != nil {
@@ -615,29 +975,57 @@ func (s *LobbyServer) runBroadcastServer(broadcastPort int) {
 	}
 	defer broadcastServer.Close()
 
-	s.Logger.Info("listening for broadcasts")
+	s.Logger.Info("listening for broadcasts", "broadcast", !s.DisableBroadcast, "stun", !s.DisableSTUN)
 	for {
 		buf := make([]byte, 1500) //nolint:gomnd
-		_, addr, err := broadcastServer.ReadFromUDP(buf)
+		n, addr, err := broadcastServer.ReadFromUDP(buf)
 		if err != nil {
 			s.Logger.Error(err, "error reading broadcast packet")
 			continue
 		}
-		s.processBroadcast(broadcastServer, addr, buf)
+		if isSTUNRequest(buf[:n]) {
+			if !s.DisableSTUN {
+				s.processSTUN(broadcastServer, addr, buf[:n])
+			}
+		} else if !s.DisableBroadcast {
+			s.processBroadcast(broadcastServer, addr, buf)
+		}
 	}
 }
 
 func (s *LobbyServer) RunSocketServer(broadcastPort int) error {
+	s.gameServersMutex.Lock()
 	s.GameServers = make(map[string]*gameserver.GameServer)
-	if !s.DisableBroadcast {
+	s.gameServersMutex.Unlock()
+	if !s.DisableBroadcast || !s.DisableSTUN {
 		go s.runBroadcastServer(broadcastPort)
 	}
+	if !s.DisableSTUN && s.STUNAltPort != 0 {
+		go s.runSTUNServer(s.STUNAltPort)
+	}
+	if s.SaveVault != nil {
+		go s.pruneSaveVault()
+	}
+	if s.Notifier == nil {
+		s.Notifier = notifier.NewDispatcher(s.Logger, nil, notifier.QueueConfig{}) // only the <EMULATOR>_CHANNEL_<n> environment variables
+	}
+	s.notify(notifier.Event{Type: notifier.EventServerStart, Server: s.Name})
 
 	server := websocket.Server{
 		Handler:   s.wsHandler,
 		Handshake: nil,
 	}
 	http.Handle("/", server)
+	http.Handle("/input", websocket.Server{
+		Handler:   s.inputHandler,
+		Handshake: nil,
+	})
+	http.HandleFunc("/uploads", s.uploadsHandler)
+	if s.History != nil {
+		http.Handle("/history", s.History.Handler(s.Logger))
+		http.Handle("/stats", s.History.StatsHandler(s.Logger))
+		http.Handle("/leaderboard", s.History.LeaderboardHandler(s.Logger))
+	}
 	listenAddress := fmt.Sprintf(":%d", s.BasePort)
 
 	s.Logger.Info("server running", "address", listenAddress, "version", getVersion(), "platform", runtime.GOOS, "arch", runtime.GOARCH, "goversion", runtime.Version(), "enable-auth", s.EnableAuth)
@@ -653,11 +1041,32 @@ func (s *LobbyServer) LogServerStats() {
 	for {
 		memStats := runtime.MemStats{}
 		runtime.ReadMemStats(&memStats)
-		s.Logger.Info("server stats", "games", len(s.GameServers), "NumGoroutine", runtime.NumGoroutine(), "HeapAlloc", memStats.HeapAlloc, "HeapObjects", memStats.HeapObjects)
+		gameServers := s.gameServers()
+		s.Logger.Info("server stats", "games", len(gameServers), "NumGoroutine", runtime.NumGoroutine(), "HeapAlloc", memStats.HeapAlloc, "HeapObjects", memStats.HeapObjects, "uploadBytes", s.UploadBudget.Used())
+		for i, v := range gameServers {
+			if uploadBytes := v.UploadBytes(); uploadBytes > 0 {
+				s.Logger.Info("room stats", "room", i, "port", v.Port, "uploadBytes", uploadBytes)
+			}
+		}
+		if s.Notifier != nil {
+			s.Logger.Info("notification stats", "metrics", s.Notifier.Queue.Metrics())
+		}
 		time.Sleep(time.Minute)
 	}
 }
 
+func (s *LobbyServer) pruneSaveVault() {
+	for {
+		removed, err := s.SaveVault.Prune()
+		if err != nil {
+			s.Logger.Error(err, "could not prune save vault")
+		} else if removed > 0 {
+			s.Logger.Info("pruned save vault", "removed", removed)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
 func getVersion() string {
 	version := "unknown"
 	if info, ok := debug.ReadBuildInfo(); ok {
@@ -671,7 +1080,7 @@ func getVersion() string {
 }
 
 func (s *LobbyServer) updateLastActivity(ws *websocket.Conn) {
-	for _, g := range s.GameServers {
+	for _, g := range s.gameServers() {
 		for _, player := range g.Players {
 			if player.Socket == ws {
 				g.LastActivity = time.Now()
@@ -682,17 +1091,19 @@ func (s *LobbyServer) updateLastActivity(ws *websocket.Conn) {
 }
 
 func (s *LobbyServer) handlePlayerDrop(ws *websocket.Conn) {
-	for roomName, g := range s.GameServers {
+	for roomName, g := range s.gameServers() {
 		for playerName, player := range g.Players {
 			if player.Socket == ws {
-				delete(g.Players, playerName)
+				s.removePlayer(g, playerName)
+				s.updatePlayers(g)
+				s.roomChanged(roomName, g)
 				s.Logger.Info("Player dropped", "player", playerName, "room", roomName)
 				if len(g.Players) == 0 {
 					// Remove the port from the active ports list
 					s.removePort(g.Port)
 
-					delete(s.GameServers, roomName)
 					s.Logger.Info("Room deleted due to no active players", "room", roomName)
+					g.CloseServers()
 				}
 				return
 			}
@@ -700,27 +1111,6 @@ func (s *LobbyServer) handlePlayerDrop(ws *websocket.Conn) {
 	}
 }
 
-// Function to purge inactive rooms
-func (s *LobbyServer) purgeInactiveRooms() {
-	for {
-		time.Sleep(5 * time.Minute) // Check every 5 minutes
-		now := time.Now()
-		for roomName, g := range s.GameServers {
-			if now.Sub(g.LastActivity) > 10*time.Minute { // Inactive for more than 10 minutes
-				// Clear the ports before deleting the game server
-				g.TCPListener = nil // Clear TCP listener
-				g.UDPListener = nil // Clear UDP listener
-
-				// Remove the port from the active ports list
-				s.removePort(g.Port)
-
-				delete(s.GameServers, roomName)
-				s.Logger.Info("Room purged due to inactivity", "room", roomName)
-			}
-		}
-	}
-}
-
 // Function to remove a port from the active ports list
 func (s *LobbyServer) removePort(port int) {
 	for i, p := range s.ActivePorts {
@@ -0,0 +1,75 @@
+package lobbyserver
+
+import (
+	"sort"
+	"time"
+
+	gameserver "github.com/simple64/mpn-server/internal/gameServer"
+	"github.com/simple64/mpn-server/internal/notifier"
+)
+
+// roomPlayers returns the names of the players in g, in slot order.
+func roomPlayers(g *gameserver.GameServer) []string {
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	names := make([]string, 0, len(g.Players))
+	for name := range g.Players {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return g.Players[names[i]].Number < g.Players[names[j]].Number })
+	return names
+}
+
+func (s *LobbyServer) roomEvent(eventType string, roomName string, g *gameserver.GameServer) notifier.Event {
+	return notifier.Event{
+		Type:     eventType,
+		Server:   s.Name,
+		Emulator: g.Emulator,
+		Room:     roomName,
+		Game:     g.GameName,
+		Players:  roomPlayers(g),
+		Port:     g.Port,
+		Private:  g.Password != "",
+	}
+}
+
+func (s *LobbyServer) notify(event notifier.Event) {
+	if s.Notifier != nil {
+		s.Notifier.Notify(event)
+	}
+}
+
+// notifyGameEnded announces a finished game with how long it ran.
+func (s *LobbyServer) notifyGameEnded(roomName string, g *gameserver.GameServer, summary gameserver.GameSummary) {
+	event := s.roomEvent(notifier.EventGameEnded, roomName, g)
+	event.Duration = (time.Duration(summary.DurationMs) * time.Millisecond).Round(time.Second)
+	s.notify(event)
+}
+
+// updateRoomAnnouncement edits the announcements of a room in the lobby after players join or leave.
+func (s *LobbyServer) updateRoomAnnouncement(roomName string, g *gameserver.GameServer) {
+	if s.Notifier == nil || g.State() != gameserver.StateLobby || len(g.Players) == 0 {
+		return
+	}
+	s.Notifier.UpdateRoom(s.roomEvent(notifier.EventRoomCreated, roomName, g))
+}
+
+// closeRoomAnnouncement stops following a destroyed room's announcements, deleting them if it never started.
+func (s *LobbyServer) closeRoomAnnouncement(g *gameserver.GameServer) {
+	if s.Notifier != nil {
+		s.Notifier.CloseRoom(g.Port, !g.StateTime(gameserver.StateStarting).IsZero())
+	}
+}
+
+// NotifyServerStop announces that the server is going down, and takes down the announcements of
+// rooms still waiting in the lobby.
+func (s *LobbyServer) NotifyServerStop() {
+	if s.Notifier != nil {
+		for _, g := range s.gameServers() {
+			if g.State() == gameserver.StateLobby {
+				s.Notifier.CloseRoom(g.Port, false)
+			}
+		}
+	}
+	s.notify(notifier.Event{Type: notifier.EventServerStop, Server: s.Name})
+}
@@ -0,0 +1,262 @@
+package lobbyserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	gameserver "github.com/simple64/mpn-server/internal/gameServer"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	maxPlayers        = 4
+	roomUpdatesQueued = 64 // room list changes waiting for a subscriber, one that falls further behind is dropped
+)
+
+// roomSubscriber is a socket watching the room list. Changes are sent by its own goroutine, so a
+// socket that stops reading only holds up itself.
+type roomSubscriber struct {
+	emulator string // whose rooms it sees
+	updates  chan SocketMessage
+}
+
+// roomSubscribers are the sockets watching the room list.
+type roomSubscribers struct {
+	sockets map[*websocket.Conn]*roomSubscriber
+	mutex   sync.Mutex
+}
+
+// roomInfo describes a room the way the room list shows it.
+func (s *LobbyServer) roomInfo(messageType string, roomName string, g *gameserver.GameServer) SocketMessage {
+	g.PlayersMutex.Lock()
+	playerCount := len(g.Players)
+	host := g.PlayerName
+	locked := g.Locked
+	g.PlayersMutex.Unlock()
+	return SocketMessage{
+		Type:        messageType,
+		Accept:      Accepted,
+		Protected:   g.Password != "",
+		RoomName:    roomName,
+		MD5:         g.MD5,
+		Port:        g.Port,
+		GameName:    g.GameName,
+		Features:    g.Features,
+		PlayerName:  host,
+		Region:      g.Region,
+		Locked:      locked,
+		PlayerCount: playerCount,
+		SlotsFree:   maxPlayers - playerCount,
+		RoomState:   g.State().String(),
+		PakPolicy:   &g.PakPolicy,
+	}
+}
+
+// listed reports whether g shows up in the room list. Rooms are listed from the moment they open
+// until they end, so subscribers can tell a game that started from one that is gone.
+func listed(g *gameserver.GameServer) bool {
+	return g.State() == gameserver.StateLobby || g.InGame()
+}
+
+// subscribeRooms sends ws every listed room for emulator, followed by TypeReplyRoomsEnd, and then
+// keeps it up to date with TypeReplyRoomAdded, TypeReplyRoomUpdated and TypeReplyRoomRemoved.
+func (s *LobbyServer) subscribeRooms(ws *websocket.Conn, emulator string) {
+	// subscribed before the snapshot is taken, so no change can fall in between; at worst
+	// a room shows up in both, which clients handle like any other update
+	subscriber := &roomSubscriber{emulator: emulator, updates: make(chan SocketMessage, roomUpdatesQueued)}
+	s.rooms.mutex.Lock()
+	if s.rooms.sockets == nil {
+		s.rooms.sockets = make(map[*websocket.Conn]*roomSubscriber)
+	}
+	if old, ok := s.rooms.sockets[ws]; ok {
+		close(old.updates)
+	}
+	s.rooms.sockets[ws] = subscriber
+	s.rooms.mutex.Unlock()
+
+	for roomName, g := range s.gameServers() {
+		if g.Emulator != emulator || !listed(g) {
+			continue
+		}
+		sendMessage := s.roomInfo(TypeReplySubscribeRooms, roomName, g)
+		if err := s.sendData(ws, sendMessage); err != nil {
+			s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+		}
+	}
+	sendMessage := SocketMessage{Type: TypeReplyRoomsEnd, Accept: Accepted}
+	if err := s.sendData(ws, sendMessage); err != nil {
+		s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+	}
+	go s.sendRoomUpdates(ws, subscriber.updates) // changes queued meanwhile follow the snapshot
+}
+
+// sendRoomUpdates sends ws the room list changes published for it until it is unsubscribed.
+func (s *LobbyServer) sendRoomUpdates(ws *websocket.Conn, updates chan SocketMessage) {
+	for sendMessage := range updates {
+		if err := s.sendData(ws, sendMessage); err != nil {
+			s.Logger.Error(err, "failed to send message", "message", sendMessage, "address", ws.Request().RemoteAddr)
+		}
+	}
+}
+
+func (s *LobbyServer) unsubscribeRooms(ws *websocket.Conn) {
+	s.rooms.mutex.Lock()
+	defer s.rooms.mutex.Unlock()
+	if subscriber, ok := s.rooms.sockets[ws]; ok {
+		close(subscriber.updates)
+		delete(s.rooms.sockets, ws)
+	}
+}
+
+// publishRoom queues a room list change for the subscribers of the room's emulator. It never blocks,
+// because rooms publish from their state hooks: a subscriber whose queue is full is dropped.
+func (s *LobbyServer) publishRoom(sendMessage SocketMessage, emulator string) {
+	s.rooms.mutex.Lock()
+	defer s.rooms.mutex.Unlock()
+	for ws, subscriber := range s.rooms.sockets {
+		if subscriber.emulator != emulator {
+			continue
+		}
+		select {
+		case subscriber.updates <- sendMessage:
+		default:
+			close(subscriber.updates)
+			delete(s.rooms.sockets, ws)
+			s.Logger.Info("room list subscriber is not keeping up, unsubscribed", "address", ws.Request().RemoteAddr)
+		}
+	}
+}
+
+// publishRoomState tells subscribers that a room opened, started or went away.
+func (s *LobbyServer) publishRoomState(roomName string, g *gameserver.GameServer, to gameserver.RoomState) {
+	switch {
+	case roomName == "":
+		return
+	case to == gameserver.StateLobby:
+		s.publishRoom(s.roomInfo(TypeReplyRoomAdded, roomName, g), g.Emulator)
+	case to == gameserver.StateEnded:
+		s.publishRoom(SocketMessage{Type: TypeReplyRoomRemoved, Accept: Accepted, RoomName: roomName, Port: g.Port}, g.Emulator)
+	case listed(g):
+		s.publishRoom(s.roomInfo(TypeReplyRoomUpdated, roomName, g), g.Emulator)
+	}
+}
+
+// roomChanged must be called after players join or leave a room, to update everyone watching it.
+func (s *LobbyServer) roomChanged(roomName string, g *gameserver.GameServer) {
+	if len(g.Players) == 0 { // the room is about to close
+		return
+	}
+	s.publishRoom(s.roomInfo(TypeReplyRoomUpdated, roomName, g), g.Emulator)
+	s.updateRoomAnnouncement(roomName, g)
+}
+
+// Room list sort orders.
+const (
+	SortName    = "name"
+	SortGame    = "game"
+	SortPlayers = "players" // most players first
+	SortNewest  = "newest"
+	SortOldest  = "oldest"
+)
+
+// RoomFilter narrows down, orders and pages the rooms returned for TypeRequestGetRooms.
+type RoomFilter struct {
+	Features      map[string]string `json:"features,omitempty"`  // every one must be set to the same value in the room
+	GameName      string            `json:"game_name,omitempty"` // part of the game name, ignoring case
+	MD5           string            `json:"MD5,omitempty"`
+	Region        string            `json:"region,omitempty"`
+	Sort          string            `json:"sort,omitempty"`
+	Offset        int               `json:"offset,omitempty"`
+	Limit         int               `json:"limit,omitempty"` // 0 means every room
+	HideProtected bool              `json:"hide_protected,omitempty"`
+	HideFull      bool              `json:"hide_full,omitempty"` // also hides locked rooms
+}
+
+type listedRoom struct {
+	g           *gameserver.GameServer
+	name        string
+	playerCount int
+	locked      bool
+}
+
+func (f *RoomFilter) matches(room *listedRoom) bool {
+	g := room.g
+	if f.GameName != "" && !strings.Contains(strings.ToLower(g.GameName), strings.ToLower(f.GameName)) {
+		return false
+	}
+	if f.MD5 != "" && !strings.EqualFold(f.MD5, g.MD5) {
+		return false
+	}
+	if f.Region != "" && !strings.EqualFold(f.Region, g.Region) {
+		return false
+	}
+	if f.HideProtected && g.Password != "" {
+		return false
+	}
+	if f.HideFull && (room.playerCount >= maxPlayers || room.locked) {
+		return false
+	}
+	for k, v := range f.Features {
+		if g.Features[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// findRooms returns the rooms in the lobby for emulator that match filter, in its order and
+// page, along with how many matched in total. A nil filter returns every room.
+func (s *LobbyServer) findRooms(emulator string, filter *RoomFilter) ([]*listedRoom, int, error) {
+	if filter == nil {
+		filter = &RoomFilter{}
+	}
+	var less func(a, b *listedRoom) bool
+	switch filter.Sort {
+	case SortName, "":
+		less = func(a, b *listedRoom) bool { return a.name < b.name }
+	case SortGame:
+		less = func(a, b *listedRoom) bool { return a.g.GameName < b.g.GameName }
+	case SortPlayers:
+		less = func(a, b *listedRoom) bool { return a.playerCount > b.playerCount }
+	case SortNewest:
+		less = func(a, b *listedRoom) bool { return a.g.CreationTime.After(b.g.CreationTime) }
+	case SortOldest:
+		less = func(a, b *listedRoom) bool { return a.g.CreationTime.Before(b.g.CreationTime) }
+	default:
+		return nil, 0, fmt.Errorf("invalid sort %q", filter.Sort)
+	}
+	if filter.Offset < 0 || filter.Limit < 0 {
+		return nil, 0, fmt.Errorf("invalid page")
+	}
+
+	var rooms []*listedRoom
+	for name, g := range s.gameServers() {
+		if g.State() != gameserver.StateLobby || g.Emulator != emulator {
+			continue
+		}
+		g.PlayersMutex.Lock()
+		room := &listedRoom{g: g, name: name, playerCount: len(g.Players), locked: g.Locked}
+		g.PlayersMutex.Unlock()
+		if filter.matches(room) {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if less(rooms[i], rooms[j]) != less(rooms[j], rooms[i]) {
+			return less(rooms[i], rooms[j])
+		}
+		return rooms[i].name < rooms[j].name
+	})
+
+	total := len(rooms)
+	if filter.Offset >= total {
+		return nil, total, nil
+	}
+	rooms = rooms[filter.Offset:]
+	if filter.Limit > 0 && len(rooms) > filter.Limit {
+		rooms = rooms[:filter.Limit]
+	}
+	return rooms, total, nil
+}
@@ -0,0 +1,168 @@
+package lobbyserver
+
+import (
+	"fmt"
+
+	gameserver "github.com/simple64/mpn-server/internal/gameServer"
+	"golang.org/x/net/websocket"
+)
+
+// assignSlot adds a joining player to the room in the slot they asked for, or the first free one if
+// requested is nil. The slot is checked and taken under one PlayersMutex lock, so two players
+// joining at once cannot both get the same slot, or a room that has one place left.
+func assignSlot(g *gameserver.GameServer, requested *int, playerName string, client gameserver.Client) (int, int, string) {
+	if requested != nil && !validSlot(*requested) {
+		return 0, Other, fmt.Sprintf("Slot must be between 0 and %d", maxPlayers-1)
+	}
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	if _, ok := g.Players[playerName]; ok {
+		return 0, DuplicateName, "Player name already in use"
+	}
+	if len(g.Players) >= maxPlayers {
+		return 0, RoomFull, "Room is full"
+	}
+	taken := make([]bool, maxPlayers)
+	for _, v := range g.Players {
+		taken[v.Number] = true
+	}
+	number := 0
+	if requested != nil {
+		number = *requested
+		if taken[number] {
+			return 0, SlotTaken, "Slot is already taken"
+		}
+	} else {
+		for taken[number] {
+			number++
+		}
+	}
+	client.Number = number
+	g.Players[playerName] = client
+	return number, Accepted, ""
+}
+
+func validSlot(slot int) bool {
+	return slot >= 0 && slot < maxPlayers
+}
+
+func slotReplyType(requestType string) string {
+	switch requestType {
+	case TypeRequestSwapSlots:
+		return TypeReplySwapSlots
+	case TypeRequestDeclineSwap:
+		return TypeReplyDeclineSwap
+	default:
+		return TypeReplySetSlot
+	}
+}
+
+// moveSlot puts playerName in slot, trading places with whoever was there.
+// The caller must hold PlayersMutex.
+func moveSlot(g *gameserver.GameServer, playerName string, slot int) {
+	player := g.Players[playerName]
+	for name, v := range g.Players {
+		if v.Number == slot && name != playerName {
+			v.Number = player.Number
+			v.SwapWith = ""
+			g.Players[name] = v
+		}
+	}
+	player.Number = slot
+	player.SwapWith = ""
+	g.Players[playerName] = player
+}
+
+// handleSlotRequest lets players trade slots in the lobby: a swap happens once both players asked
+// for it, and the host can put any player in any slot.
+func (s *LobbyServer) handleSlotRequest(ws *websocket.Conn, receivedMessage SocketMessage) SocketMessage {
+	sendMessage := SocketMessage{
+		Type:         slotReplyType(receivedMessage.Type),
+		Port:         receivedMessage.Port,
+		TargetPlayer: receivedMessage.TargetPlayer,
+	}
+	roomName, g := s.findGameServer(receivedMessage.Port)
+	if g == nil {
+		sendMessage.Accept = RoomDeleted
+		sendMessage.Message = "room has been deleted"
+		return sendMessage
+	}
+	sendMessage.RoomName = roomName
+	playerName, ok := s.findPlayer(g, ws)
+	switch {
+	case !ok:
+		sendMessage.Accept = BadName
+		sendMessage.Message = "You are not in this room"
+		return sendMessage
+	case g.State() != gameserver.StateLobby:
+		sendMessage.Accept = Other
+		sendMessage.Message = "Slots can only change before the game starts"
+		return sendMessage
+	case receivedMessage.Type == TypeRequestSetSlot && !s.isHost(g, ws):
+		sendMessage.Accept = NotHost
+		sendMessage.Message = "Only the host can assign slots"
+		return sendMessage
+	}
+
+	g.PlayersMutex.Lock()
+	target, ok := g.Players[receivedMessage.TargetPlayer]
+	if !ok || receivedMessage.TargetPlayer == playerName && receivedMessage.Type != TypeRequestSetSlot {
+		g.PlayersMutex.Unlock()
+		sendMessage.Accept = BadName
+		sendMessage.Message = "Player is not in this room"
+		return sendMessage
+	}
+
+	var notify *websocket.Conn // the other player, told about a swap request or a declined one
+	notifyMessage := SocketMessage{Port: g.Port, RoomName: roomName, PlayerName: playerName}
+	moved := false
+	switch receivedMessage.Type {
+	case TypeRequestSetSlot:
+		if receivedMessage.Slot == nil || !validSlot(*receivedMessage.Slot) {
+			g.PlayersMutex.Unlock()
+			sendMessage.Accept = Other
+			sendMessage.Message = fmt.Sprintf("Slot must be between 0 and %d", maxPlayers-1)
+			return sendMessage
+		}
+		moveSlot(g, receivedMessage.TargetPlayer, *receivedMessage.Slot)
+		moved = true
+	case TypeRequestSwapSlots:
+		if target.SwapWith == playerName { // they asked first, so both agree
+			moveSlot(g, playerName, target.Number)
+			moved = true
+		} else {
+			player := g.Players[playerName]
+			player.SwapWith = receivedMessage.TargetPlayer
+			g.Players[playerName] = player
+			notify = target.Socket
+			notifyMessage.Type = TypeReplySwapRequest
+			notifyMessage.Slot = &player.Number
+		}
+	case TypeRequestDeclineSwap:
+		if target.SwapWith != playerName {
+			g.PlayersMutex.Unlock()
+			sendMessage.Accept = Other
+			sendMessage.Message = "No swap was requested"
+			return sendMessage
+		}
+		target.SwapWith = ""
+		g.Players[receivedMessage.TargetPlayer] = target
+		notify = target.Socket
+		notifyMessage.Type = TypeReplySwapDeclined
+	}
+	g.PlayersMutex.Unlock()
+
+	sendMessage.Accept = Accepted
+	if notify != nil {
+		if err := s.sendData(notify, notifyMessage); err != nil {
+			s.Logger.Error(err, "failed to send message", "message", notifyMessage, "address", notify.Request().RemoteAddr)
+		}
+	}
+	if moved {
+		s.Logger.Info("player slots changed", "room", roomName, "by", playerName, "player", receivedMessage.TargetPlayer)
+		g.NotifyPlayersChanged()
+		s.updatePlayers(g)
+		s.roomChanged(roomName, g)
+	}
+	return sendMessage
+}
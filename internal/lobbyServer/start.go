@@ -0,0 +1,277 @@
+package lobbyserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	gameserver "github.com/simple64/mpn-server/internal/gameServer"
+	"github.com/simple64/mpn-server/internal/notifier"
+	"golang.org/x/net/websocket"
+)
+
+const MaxCountdown = 30 // seconds
+
+// StartRules are the conditions the host sets for starting the game. The zero value starts
+// the game as soon as the host asks.
+type StartRules struct {
+	MinPlayers int  `json:"min_players,omitempty"`
+	Countdown  int  `json:"countdown,omitempty"` // seconds between the host starting and the game starting
+	AllReady   bool `json:"all_ready,omitempty"` // every player but the host must be ready
+}
+
+type roomStart struct {
+	cancel chan struct{} // set while a countdown runs, closed to stop it
+	rules  StartRules
+}
+
+// roomStarts are the start rules and countdowns of every room.
+type roomStarts struct {
+	rooms map[*gameserver.GameServer]*roomStart
+	mutex sync.Mutex
+}
+
+// roomStart returns the start state of g. The caller must hold the mutex.
+func (s *LobbyServer) roomStart(g *gameserver.GameServer) *roomStart {
+	if s.starts.rooms == nil {
+		s.starts.rooms = make(map[*gameserver.GameServer]*roomStart)
+	}
+	start, ok := s.starts.rooms[g]
+	if !ok {
+		start = &roomStart{}
+		s.starts.rooms[g] = start
+	}
+	return start
+}
+
+func (s *LobbyServer) startRules(g *gameserver.GameServer) StartRules {
+	s.starts.mutex.Lock()
+	defer s.starts.mutex.Unlock()
+	return s.roomStart(g).rules
+}
+
+// forgetStart stops a running countdown and drops the room's rules once it ends.
+func (s *LobbyServer) forgetStart(g *gameserver.GameServer) {
+	s.starts.mutex.Lock()
+	defer s.starts.mutex.Unlock()
+	if start, ok := s.starts.rooms[g]; ok && start.cancel != nil {
+		close(start.cancel)
+	}
+	delete(s.starts.rooms, g)
+}
+
+// startProblem returns why the game cannot start under rules yet, or "" if it can.
+func startProblem(g *gameserver.GameServer, rules StartRules) string {
+	g.PlayersMutex.Lock()
+	defer g.PlayersMutex.Unlock()
+	if len(g.Players) < rules.MinPlayers {
+		return fmt.Sprintf("Waiting for %d players", rules.MinPlayers)
+	}
+	if rules.AllReady {
+		for name, v := range g.Players {
+			if name != g.PlayerName && !v.Ready { // the host is ready by starting
+				return fmt.Sprintf("Waiting for %s to be ready", name)
+			}
+		}
+	}
+	return ""
+}
+
+// sendPlayers sends message to everyone in the room.
+func (s *LobbyServer) sendPlayers(g *gameserver.GameServer, message SocketMessage) {
+	g.PlayersMutex.Lock()
+	sockets := make([]*websocket.Conn, 0, len(g.Players))
+	for _, v := range g.Players {
+		sockets = append(sockets, v.Socket)
+	}
+	g.PlayersMutex.Unlock()
+	for _, ws := range sockets {
+		if err := s.sendData(ws, message); err != nil {
+			s.Logger.Error(err, "failed to send message", "message", message, "address", ws.Request().RemoteAddr)
+		}
+	}
+}
+
+// setReady marks the player on ws as ready or not.
+func (s *LobbyServer) setReady(ws *websocket.Conn, receivedMessage SocketMessage) {
+	_, g := s.findGameServer(receivedMessage.Port)
+	if g == nil {
+		s.Logger.Error(fmt.Errorf("could not find game server"), "server not found", "message", receivedMessage, "address", ws.Request().RemoteAddr)
+		return
+	}
+	playerName, ok := s.findPlayer(g, ws)
+	if !ok {
+		s.Logger.Error(fmt.Errorf("player not in room"), "could not change ready", "message", receivedMessage, "address", ws.Request().RemoteAddr)
+		return
+	}
+	g.PlayersMutex.Lock()
+	client := g.Players[playerName]
+	client.Ready = receivedMessage.Ready
+	g.Players[playerName] = client
+	g.PlayersMutex.Unlock()
+	s.updatePlayers(g)
+}
+
+// setStartRules lets the host change the room's start rules.
+func (s *LobbyServer) setStartRules(ws *websocket.Conn, receivedMessage SocketMessage) SocketMessage {
+	sendMessage := SocketMessage{Type: TypeReplyStartRules, Port: receivedMessage.Port}
+	roomName, g := s.findGameServer(receivedMessage.Port)
+	rules := receivedMessage.StartRules
+	switch {
+	case g == nil:
+		sendMessage.Accept = RoomDeleted
+		sendMessage.Message = "room has been deleted"
+	case !s.isHost(g, ws):
+		sendMessage.Accept = NotHost
+		sendMessage.Message = "Only the host can change the start rules"
+	case rules == nil || rules.MinPlayers < 0 || rules.MinPlayers > maxPlayers:
+		sendMessage.Accept = Other
+		sendMessage.Message = fmt.Sprintf("Minimum players must be between 0 and %d", maxPlayers)
+	case rules.Countdown < 0 || rules.Countdown > MaxCountdown:
+		sendMessage.Accept = Other
+		sendMessage.Message = fmt.Sprintf("Countdown must be between 0 and %d seconds", MaxCountdown)
+	default:
+		s.starts.mutex.Lock()
+		s.roomStart(g).rules = *rules
+		s.starts.mutex.Unlock()
+		s.Logger.Info("start rules changed", "room", roomName, "rules", *rules)
+		sendMessage.Accept = Accepted
+		sendMessage.RoomName = roomName
+		sendMessage.StartRules = rules
+		s.updatePlayers(g)
+	}
+	return sendMessage
+}
+
+// requestStart starts the game for the host once the room's start rules are met, after the
+// countdown if there is one. It returns a TypeReplyStartCountdown refusal for the host if it cannot.
+func (s *LobbyServer) requestStart(ws *websocket.Conn, receivedMessage SocketMessage) *SocketMessage {
+	refuse := func(accept int, message string) *SocketMessage {
+		return &SocketMessage{Type: TypeReplyStartCountdown, Port: receivedMessage.Port, Accept: accept, Message: message}
+	}
+	roomName, g := s.findGameServer(receivedMessage.Port)
+	if g == nil {
+		s.Logger.Error(fmt.Errorf("could not find game server"), "server not found", "message", receivedMessage, "address", ws.Request().RemoteAddr)
+		return refuse(RoomDeleted, "room has been deleted")
+	}
+	if g.State() != gameserver.StateLobby {
+		s.Logger.Error(fmt.Errorf("game already running"), "game running", "message", receivedMessage, "state", g.State().String(), "address", ws.Request().RemoteAddr)
+		return refuse(Other, "The game is already running")
+	}
+	if !s.isHost(g, ws) {
+		return refuse(NotHost, "Only the host can start the game")
+	}
+
+	s.starts.mutex.Lock()
+	start := s.roomStart(g)
+	rules := start.rules
+	if start.cancel != nil {
+		s.starts.mutex.Unlock()
+		return refuse(Other, "The game is already starting")
+	}
+	if problem := startProblem(g, rules); problem != "" {
+		s.starts.mutex.Unlock()
+		return refuse(NotReady, problem)
+	}
+	if rules.Countdown == 0 {
+		s.starts.mutex.Unlock()
+		s.beginGame(roomName, g)
+		return nil
+	}
+	cancel := make(chan struct{})
+	start.cancel = cancel
+	s.starts.mutex.Unlock()
+
+	s.Logger.Info("starting countdown", "room", roomName, "seconds", rules.Countdown)
+	go s.runCountdown(roomName, g, rules, cancel)
+	return nil
+}
+
+// runCountdown tells the players how long until the game starts once a second, then starts it.
+// It gives up if the start rules stop being met, such as when a player leaves or is no longer ready.
+func (s *LobbyServer) runCountdown(roomName string, g *gameserver.GameServer, rules StartRules, cancel chan struct{}) {
+	startAt := time.Now().Add(time.Duration(rules.Countdown) * time.Second)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for remaining := rules.Countdown; ; remaining-- {
+		problem := startProblem(g, rules)
+		if problem == "" && g.State() != gameserver.StateLobby {
+			problem = "The room closed"
+		}
+		if problem != "" {
+			s.stopCountdown(g, cancel, NotReady, problem)
+			return
+		}
+		if remaining == 0 {
+			break
+		}
+		s.sendPlayers(g, SocketMessage{
+			Type:      TypeReplyStartCountdown,
+			Port:      g.Port,
+			Countdown: remaining,
+			StartAt:   startAt.UnixMilli(),
+		})
+		select {
+		case <-ticker.C:
+		case <-cancel:
+			return
+		}
+	}
+
+	s.starts.mutex.Lock()
+	select {
+	case <-cancel: // cancelled just now
+		s.starts.mutex.Unlock()
+		return
+	default:
+	}
+	s.roomStart(g).cancel = nil
+	s.starts.mutex.Unlock()
+	s.beginGame(roomName, g)
+}
+
+// stopCountdown cancels the countdown, if it is still the one running, and tells the players why.
+func (s *LobbyServer) stopCountdown(g *gameserver.GameServer, cancel chan struct{}, accept int, reason string) bool {
+	s.starts.mutex.Lock()
+	start, ok := s.starts.rooms[g]
+	if !ok || start.cancel == nil || (cancel != nil && start.cancel != cancel) {
+		s.starts.mutex.Unlock()
+		return false
+	}
+	close(start.cancel)
+	start.cancel = nil
+	s.starts.mutex.Unlock()
+
+	g.Logger.Info("countdown cancelled", "reason", reason)
+	s.sendPlayers(g, SocketMessage{Type: TypeReplyStartCountdown, Port: g.Port, Accept: accept, Message: reason})
+	return true
+}
+
+// cancelStart lets the host stop the countdown.
+func (s *LobbyServer) cancelStart(ws *websocket.Conn, receivedMessage SocketMessage) *SocketMessage {
+	_, g := s.findGameServer(receivedMessage.Port)
+	switch {
+	case g == nil:
+		return &SocketMessage{Type: TypeReplyStartCountdown, Port: receivedMessage.Port, Accept: RoomDeleted, Message: "room has been deleted"}
+	case !s.isHost(g, ws):
+		return &SocketMessage{Type: TypeReplyStartCountdown, Port: receivedMessage.Port, Accept: NotHost, Message: "Only the host can stop the countdown"}
+	case !s.stopCountdown(g, nil, Other, "The host stopped the countdown"):
+		return &SocketMessage{Type: TypeReplyStartCountdown, Port: receivedMessage.Port, Accept: Other, Message: "No countdown is running"}
+	}
+	return nil
+}
+
+// beginGame starts the room's game and tells every player to launch it.
+func (s *LobbyServer) beginGame(roomName string, g *gameserver.GameServer) {
+	if !s.checkRoomData(g) {
+		s.Logger.Info("refused to start game with mismatched or unreported data", "room", roomName)
+		return
+	}
+	if err := g.Transition(gameserver.StateStarting); err != nil {
+		s.Logger.Error(err, "could not start game", "room", roomName)
+		return
+	}
+	g.Logger.Info("starting game", "time", g.StartTime.Format(time.RFC3339))
+	s.notify(s.roomEvent(notifier.EventGameStarted, roomName, g))
+	s.sendPlayers(g, SocketMessage{Type: TypeReplyBeginGame, Port: g.Port})
+}
@@ -0,0 +1,128 @@
+package lobbyserver
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+)
+
+// A minimal RFC 5389 binding responder, so clients can learn their reflexive address before
+// joining a room. Comparing the answers from the main and alternate ports (OTHER-ADDRESS)
+// tells a client whether its NAT maps each destination to a different port.
+const (
+	stunHeaderSize         = 20
+	stunMagicCookie        = 0x2112A442
+	stunBindingRequest     = 0x0001
+	stunBindingSuccess     = 0x0101
+	stunAttrMappedAddress  = 0x0001
+	stunAttrXORMapped      = 0x0020
+	stunAttrSoftware       = 0x8022
+	stunAttrOtherAddress   = 0x802C
+	stunAttrFingerprint    = 0x8028
+	stunFingerprintXOR     = 0x5354554e
+	stunFamilyIPv4         = 0x01
+	stunFamilyIPv6         = 0x02
+	stunSoftware           = "mpn-server"
+	stunFingerprintAttrLen = 8
+)
+
+func isSTUNRequest(buf []byte) bool {
+	return len(buf) >= stunHeaderSize &&
+		binary.BigEndian.Uint16(buf[0:]) == stunBindingRequest &&
+		binary.BigEndian.Uint32(buf[4:]) == stunMagicCookie &&
+		int(binary.BigEndian.Uint16(buf[2:]))+stunHeaderSize <= len(buf)
+}
+
+func appendSTUNAttribute(msg []byte, attrType uint16, value []byte) []byte {
+	header := make([]byte, 4) //nolint:gomnd,mnd
+	binary.BigEndian.PutUint16(header, attrType)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(value)))
+	msg = append(msg, header...)
+	msg = append(msg, value...)
+	for len(msg)%4 != 0 { // attributes are padded to 32 bits
+		msg = append(msg, 0)
+	}
+	return msg
+}
+
+// stunAddress encodes addr for an address attribute, XORed with the cookie and transaction ID if xorKey is set.
+func stunAddress(addr *net.UDPAddr, xorKey []byte) []byte {
+	ip := addr.IP.To4()
+	family := byte(stunFamilyIPv4)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = stunFamilyIPv6
+	}
+	value := make([]byte, 4+len(ip)) //nolint:gomnd,mnd
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port))
+	copy(value[4:], ip)
+	if xorKey != nil {
+		value[2] ^= xorKey[0]
+		value[3] ^= xorKey[1]
+		for i := range ip {
+			value[4+i] ^= xorKey[i]
+		}
+	}
+	return value
+}
+
+// stunBindingResponse builds the success response to a binding request from addr.
+// other is the server's alternate address, or nil if there is none.
+func stunBindingResponse(request []byte, addr *net.UDPAddr, other *net.UDPAddr) []byte {
+	msg := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(msg, stunBindingSuccess)
+	copy(msg[4:stunHeaderSize], request[4:stunHeaderSize]) // cookie and transaction ID
+
+	xorKey := msg[4:stunHeaderSize]
+	msg = appendSTUNAttribute(msg, stunAttrXORMapped, stunAddress(addr, xorKey))
+	msg = appendSTUNAttribute(msg, stunAttrMappedAddress, stunAddress(addr, nil))
+	if other != nil {
+		msg = appendSTUNAttribute(msg, stunAttrOtherAddress, stunAddress(other, nil))
+	}
+	msg = appendSTUNAttribute(msg, stunAttrSoftware, []byte(stunSoftware))
+
+	// the length has to include the fingerprint before it is calculated
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)-stunHeaderSize+stunFingerprintAttrLen))
+	fingerprint := make([]byte, 4) //nolint:gomnd,mnd
+	binary.BigEndian.PutUint32(fingerprint, crc32.ChecksumIEEE(msg)^stunFingerprintXOR)
+	return appendSTUNAttribute(msg, stunAttrFingerprint, fingerprint)
+}
+
+func (s *LobbyServer) processSTUN(udpServer *net.UDPConn, addr *net.UDPAddr, buf []byte) {
+	var other *net.UDPAddr
+	if s.STUNAltPort != 0 {
+		outboundIP, err := s.getOutboundIP(addr)
+		if err != nil {
+			s.Logger.Error(err, "could not get outbound IP")
+		} else {
+			other = &net.UDPAddr{IP: outboundIP, Port: s.STUNAltPort}
+		}
+	}
+	if _, err := udpServer.WriteToUDP(stunBindingResponse(buf, addr, other), addr); err != nil {
+		s.Logger.Error(err, "could not reply to STUN binding request", "address", addr.String())
+	}
+}
+
+// runSTUNServer answers binding requests on the alternate port.
+func (s *LobbyServer) runSTUNServer(port int) {
+	stunServer, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		s.Logger.Error(err, "could not listen for STUN requests", "port", port)
+		return
+	}
+	defer stunServer.Close()
+
+	s.Logger.Info("listening for STUN requests", "port", port)
+	for {
+		buf := make([]byte, 1500) //nolint:gomnd
+		n, addr, err := stunServer.ReadFromUDP(buf)
+		if err != nil {
+			s.Logger.Error(err, "error reading STUN packet")
+			continue
+		}
+		if isSTUNRequest(buf[:n]) {
+			s.processSTUN(stunServer, addr, buf[:n])
+		}
+	}
+}
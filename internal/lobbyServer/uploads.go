@@ -0,0 +1,50 @@
+package lobbyserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// roomUploads is one room's share of the upload budget.
+type roomUploads struct {
+	Room  string `json:"room"`
+	Port  int    `json:"port"`
+	Bytes int64  `json:"bytes"`
+}
+
+// uploadUsage is what /uploads reports: the upload limits and how much of them is in use.
+type uploadUsage struct {
+	Rooms         []roomUploads `json:"rooms"`
+	UsedBytes     int64         `json:"used_bytes"`
+	MaxTotalBytes int64         `json:"max_total_bytes"`
+	MaxRoomBytes  int64         `json:"max_room_bytes"`
+	MaxRoomFiles  int           `json:"max_room_files"`
+	MaxFileSize   uint32        `json:"max_file_size"`
+}
+
+// uploadsHandler serves the current upload usage of the server and of each room holding uploads.
+func (s *LobbyServer) uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	usage := uploadUsage{Rooms: []roomUploads{}, UsedBytes: s.UploadBudget.Used()}
+	if s.UploadBudget != nil {
+		usage.MaxTotalBytes = s.UploadBudget.MaxTotalBytes
+		usage.MaxRoomBytes = s.UploadBudget.MaxRoomBytes
+		usage.MaxRoomFiles = s.UploadBudget.MaxRoomFiles
+		usage.MaxFileSize = s.UploadBudget.MaxFileSize
+	}
+	for name, g := range s.gameServers() {
+		if bytes := g.UploadBytes(); bytes > 0 {
+			usage.Rooms = append(usage.Rooms, roomUploads{Room: name, Port: g.Port, Bytes: bytes})
+		}
+	}
+	sort.Slice(usage.Rooms, func(i, j int) bool { return usage.Rooms[i].Bytes > usage.Rooms[j].Bytes })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		s.Logger.Error(err, "could not write upload usage")
+	}
+}
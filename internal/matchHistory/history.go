@@ -0,0 +1,176 @@
+package matchhistory
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	DefaultQueryLimit = 100
+	MaxQueryLimit     = 1000
+)
+
+var matchesBucket = []byte("matches")
+
+// ErrOptedOut is returned by Find for a query of a player that opted out.
+var ErrOptedOut = errors.New("player opted out of match history")
+
+// MatchPlayer is one player's part in a match.
+type MatchPlayer struct {
+	Name            string  `json:"name"`
+	Disconnect      string  `json:"disconnect,omitempty"` // why the player stopped before the room ended, if they did
+	Slot            int     `json:"slot"`
+	AvgCountLag     float64 `json:"avg_count_lag"`
+	AvgBufferHealth float64 `json:"avg_buffer_health"`
+}
+
+// Match is a completed session, recorded when a started room ends.
+type Match struct {
+	Start     time.Time         `json:"start"`
+	End       time.Time         `json:"end"`
+	Features  map[string]string `json:"features,omitempty"`
+	Room      string            `json:"room"`
+	GameName  string            `json:"game_name"`
+	MD5       string            `json:"MD5"`
+	Emulator  string            `json:"emulator"`
+	ClientSha string            `json:"client_sha"`
+	Players   []MatchPlayer     `json:"players"`
+	ID        uint64            `json:"id"`
+	Desync    bool              `json:"desync"`
+	DesyncVI  uint32            `json:"desync_vi,omitempty"`
+}
+
+// Query selects matches. Empty fields match everything.
+type Query struct {
+	From   time.Time // matches that ended at or after From
+	To     time.Time // matches that started before To
+	Player string    // a player name, compared without case
+	Game   string    // part of the game name without case, or the exact ROM MD5
+	Limit  int
+}
+
+// Store keeps matches in a bbolt database, keyed by an increasing ID so the newest come last.
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second}) //nolint:gomnd,mnd
+	if err != nil {
+		return nil, fmt.Errorf("could not open match history: %s", err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(matchesBucket)
+		return err //nolint:wrapcheck
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create match history bucket: %s", err.Error())
+	}
+	return &Store{db: db}, nil
+}
+
+func (st *Store) Close() error {
+	return st.db.Close() //nolint:wrapcheck
+}
+
+// Record stores match and sets its ID.
+func (st *Store) Record(match *Match) error {
+	return st.db.Update(func(tx *bolt.Tx) error { //nolint:wrapcheck
+		bucket := tx.Bucket(matchesBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		match.ID = id
+		data, err := json.Marshal(match)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		return bucket.Put(matchKey(id), data) //nolint:wrapcheck
+	})
+}
+
+// Each calls fn for every match, newest first, until fn returns false.
+func (st *Store) Each(fn func(match *Match) bool) error {
+	return st.db.View(func(tx *bolt.Tx) error { //nolint:wrapcheck
+		cursor := tx.Bucket(matchesBucket).Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var match Match
+			if err := json.Unmarshal(v, &match); err != nil {
+				return fmt.Errorf("could not decode match %d: %s", binary.BigEndian.Uint64(k), err.Error())
+			}
+			if !fn(&match) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Find returns the matches selected by query, newest first. Players that opted out are left out
+// of every match, and querying one of them returns ErrOptedOut.
+func (st *Store) Find(query Query) ([]Match, error) {
+	optedOut, err := st.optedOut()
+	if err != nil {
+		return nil, err
+	}
+	if query.Player != "" && optedOut[playerKey(query.Player)] {
+		return nil, ErrOptedOut
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+	matches := []Match{}
+	err = st.Each(func(match *Match) bool {
+		if !query.From.IsZero() && match.End.Before(query.From) {
+			return false // matches are stored in the order they ended
+		}
+		if query.matches(match) {
+			players := make([]MatchPlayer, 0, len(match.Players))
+			for _, player := range match.Players {
+				if !optedOut[playerKey(player.Name)] {
+					players = append(players, player)
+				}
+			}
+			match.Players = players
+			matches = append(matches, *match)
+		}
+		return len(matches) < limit
+	})
+	return matches, err
+}
+
+func (query Query) matches(match *Match) bool {
+	if !query.To.IsZero() && !match.Start.Before(query.To) {
+		return false
+	}
+	if query.Game != "" && !strings.EqualFold(query.Game, match.MD5) && !strings.Contains(strings.ToLower(match.GameName), strings.ToLower(query.Game)) {
+		return false
+	}
+	if query.Player == "" {
+		return true
+	}
+	for _, player := range match.Players {
+		if strings.EqualFold(player.Name, query.Player) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchKey(id uint64) []byte {
+	key := make([]byte, 8) //nolint:gomnd,mnd
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
@@ -0,0 +1,147 @@
+package matchhistory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const dateLayout = "2006-01-02"
+
+// parseTime accepts RFC 3339 timestamps or plain dates, which mean midnight UTC.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or %s", value, dateLayout)
+	}
+	return t, nil
+}
+
+func parseQuery(r *http.Request) (Query, error) {
+	values := r.URL.Query()
+	query := Query{
+		Player: values.Get("player"),
+		Game:   values.Get("game"),
+	}
+	var err error
+	if query.From, err = parseTime(values.Get("from")); err != nil {
+		return query, err
+	}
+	if query.To, err = parseTime(values.Get("to")); err != nil {
+		return query, err
+	}
+	query.Limit, err = intParam(r, "limit", 0)
+	return query, err
+}
+
+func writeJSON(w http.ResponseWriter, logger logr.Logger, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // stats pages are hosted elsewhere
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Error(err, "could not write history response")
+	}
+}
+
+// intParam returns the integer query parameter name, or fallback if it is not set.
+func intParam(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// Handler serves GET requests for matches, filtered by the player, game, from, to and limit query parameters.
+func (st *Store) Handler(logger logr.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, logger, http.StatusMethodNotAllowed, map[string]string{"error": "only GET is supported"})
+			return
+		}
+		query, err := parseQuery(r)
+		if err != nil {
+			writeJSON(w, logger, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		matches, err := st.Find(query)
+		if errors.Is(err, ErrOptedOut) {
+			writeJSON(w, logger, http.StatusNotFound, map[string]string{"error": "no matches for this player"})
+			return
+		}
+		if err != nil {
+			logger.Error(err, "could not query match history", "query", r.URL.RawQuery)
+			writeJSON(w, logger, http.StatusInternalServerError, map[string]string{"error": "could not read match history"})
+			return
+		}
+		writeJSON(w, logger, http.StatusOK, map[string]interface{}{"matches": matches})
+	})
+}
+
+// StatsHandler serves the stats of the player query parameter, optionally for one emulator.
+func (st *Store) StatsHandler(logger logr.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, logger, http.StatusMethodNotAllowed, map[string]string{"error": "only GET is supported"})
+			return
+		}
+		player := r.URL.Query().Get("player")
+		if player == "" {
+			writeJSON(w, logger, http.StatusBadRequest, map[string]string{"error": "player is required"})
+			return
+		}
+		stats, err := st.PlayerStats(player, r.URL.Query().Get("emulator"))
+		if err != nil {
+			logger.Error(err, "could not read player stats", "query", r.URL.RawQuery)
+			writeJSON(w, logger, http.StatusInternalServerError, map[string]string{"error": "could not read player stats"})
+			return
+		}
+		if stats == nil {
+			writeJSON(w, logger, http.StatusNotFound, map[string]string{"error": "no stats for this player"})
+			return
+		}
+		writeJSON(w, logger, http.StatusOK, stats)
+	})
+}
+
+// LeaderboardHandler serves the leaderboard selected by the sort, emulator, min_games and limit query parameters.
+func (st *Store) LeaderboardHandler(logger logr.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, logger, http.StatusMethodNotAllowed, map[string]string{"error": "only GET is supported"})
+			return
+		}
+		minGames, err := intParam(r, "min_games", DefaultLeaderboardMinGames)
+		if err != nil {
+			writeJSON(w, logger, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		limit, err := intParam(r, "limit", 0)
+		if err != nil {
+			writeJSON(w, logger, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		sortBy := r.URL.Query().Get("sort")
+		board, err := st.Leaderboard(sortBy, r.URL.Query().Get("emulator"), minGames, limit)
+		if err != nil {
+			writeJSON(w, logger, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, logger, http.StatusOK, map[string]interface{}{"sort": sortBy, "players": board})
+	})
+}
@@ -0,0 +1,172 @@
+package matchhistory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const DefaultLeaderboardMinGames = 5
+
+// Leaderboard orders.
+const (
+	SortGames    = "games"
+	SortHours    = "hours"
+	SortDropRate = "drop_rate" // most reliable first
+	SortLag      = "lag"       // least lag first
+)
+
+var optOutBucket = []byte("opt_out")
+
+// PlayerStats aggregates every recorded match of one player.
+type PlayerStats struct {
+	Name        string  `json:"name"`
+	Games       int     `json:"games"`
+	Hours       float64 `json:"hours"`
+	Drops       int     `json:"drops"`
+	DropRate    float64 `json:"drop_rate"`
+	Desyncs     int     `json:"desyncs"`
+	AvgCountLag float64 `json:"avg_count_lag"`
+}
+
+// playerKey makes stats case insensitive, like player queries.
+func playerKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// SetOptOut excludes a player from stats and leaderboards, or includes them again. Their
+// matches are still recorded, so opting back in restores their stats.
+func (st *Store) SetOptOut(name string, optOut bool) error {
+	if name == "" {
+		return fmt.Errorf("player name cannot be empty")
+	}
+	return st.db.Update(func(tx *bolt.Tx) error { //nolint:wrapcheck
+		bucket, err := tx.CreateBucketIfNotExists(optOutBucket)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		if optOut {
+			return bucket.Put([]byte(playerKey(name)), []byte{1}) //nolint:wrapcheck
+		}
+		return bucket.Delete([]byte(playerKey(name))) //nolint:wrapcheck
+	})
+}
+
+func (st *Store) optedOut() (map[string]bool, error) {
+	optedOut := make(map[string]bool)
+	err := st.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(optOutBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, _ []byte) error { //nolint:wrapcheck
+			optedOut[string(k)] = true
+			return nil
+		})
+	})
+	return optedOut, err //nolint:wrapcheck
+}
+
+// Stats aggregates the matches of every player that has not opted out, keyed by lower case name.
+// emulator limits the matches to one emulator if it is not empty.
+func (st *Store) Stats(emulator string) (map[string]*PlayerStats, error) {
+	optedOut, err := st.optedOut()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]*PlayerStats)
+	lagSamples := make(map[string]int)
+	err = st.Each(func(match *Match) bool {
+		if emulator != "" && !strings.EqualFold(emulator, match.Emulator) {
+			return true
+		}
+		hours := match.End.Sub(match.Start).Hours()
+		for _, player := range match.Players {
+			key := playerKey(player.Name)
+			if optedOut[key] {
+				continue
+			}
+			s, ok := stats[key]
+			if !ok {
+				s = &PlayerStats{Name: player.Name} // matches are visited newest first, so this is the latest spelling
+				stats[key] = s
+			}
+			s.Games++
+			s.Hours += hours
+			if player.Disconnect != "" {
+				s.Drops++
+			}
+			if match.Desync {
+				s.Desyncs++
+			}
+			if player.AvgCountLag > 0 || player.AvgBufferHealth > 0 { // both are 0 if the game ended before ManageBuffer sampled it
+				s.AvgCountLag += player.AvgCountLag
+				lagSamples[key]++
+			}
+		}
+		return true
+	})
+	for key, s := range stats {
+		s.DropRate = float64(s.Drops) / float64(s.Games)
+		if lagSamples[key] > 0 {
+			s.AvgCountLag /= float64(lagSamples[key])
+		}
+	}
+	return stats, err
+}
+
+// PlayerStats returns the stats of one player, or nil if they have none or opted out.
+func (st *Store) PlayerStats(name string, emulator string) (*PlayerStats, error) {
+	stats, err := st.Stats(emulator)
+	if err != nil {
+		return nil, err
+	}
+	return stats[playerKey(name)], nil
+}
+
+// Leaderboard returns up to limit players ordered by sortBy. Players with fewer than minGames
+// games are left out, so one lucky game does not top the drop rate or lag boards.
+func (st *Store) Leaderboard(sortBy string, emulator string, minGames int, limit int) ([]PlayerStats, error) {
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+	var less func(a, b *PlayerStats) bool
+	switch sortBy {
+	case SortGames, "":
+		less = func(a, b *PlayerStats) bool { return a.Games > b.Games }
+	case SortHours:
+		less = func(a, b *PlayerStats) bool { return a.Hours > b.Hours }
+	case SortDropRate:
+		less = func(a, b *PlayerStats) bool { return a.DropRate < b.DropRate }
+	case SortLag:
+		less = func(a, b *PlayerStats) bool { return a.AvgCountLag < b.AvgCountLag }
+	default:
+		return nil, fmt.Errorf("invalid sort %q", sortBy)
+	}
+
+	stats, err := st.Stats(emulator)
+	if err != nil {
+		return nil, err
+	}
+	board := []PlayerStats{}
+	for _, s := range stats {
+		if s.Games >= minGames {
+			board = append(board, *s)
+		}
+	}
+	sort.Slice(board, func(i, j int) bool {
+		if less(&board[i], &board[j]) != less(&board[j], &board[i]) {
+			return less(&board[i], &board[j])
+		}
+		return board[i].Name < board[j].Name
+	})
+	if len(board) > limit {
+		board = board[:limit]
+	}
+	return board, nil
+}
@@ -0,0 +1,90 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// TargetConfig is one entry of the notification config file.
+type TargetConfig struct {
+	Templates      map[string]string `json:"templates"`
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`    // discord, webhook, slack or matrix
+	URL            string            `json:"url"`     // the webhook URL, or
+	URLEnv         string            `json:"url_env"` // the environment variable holding it
+	Username       string            `json:"username"`
+	Emulators      []string          `json:"emulators"`
+	Events         []string          `json:"events"`
+	IncludePrivate bool              `json:"include_private"`
+	PlainText      bool              `json:"plain_text"`
+	Static         bool              `json:"static"` // never edit or delete room announcements
+}
+
+type Config struct {
+	Targets []TargetConfig `json:"targets"`
+}
+
+// LoadConfig reads the notification targets from a JSON file.
+func LoadConfig(path string) ([]*Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read notification config: %s", err.Error())
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse notification config: %s", err.Error())
+	}
+	targets := make([]*Target, 0, len(config.Targets))
+	for i, v := range config.Targets {
+		target, err := v.target(i)
+		if err != nil {
+			return nil, fmt.Errorf("notification target %d: %s", i, err.Error())
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func (c *TargetConfig) target(index int) (*Target, error) {
+	url := c.URL
+	if c.URLEnv != "" {
+		url = os.Getenv(c.URLEnv)
+	}
+	if url == "" {
+		return nil, fmt.Errorf("no URL set")
+	}
+	for _, eventType := range c.Events {
+		if _, ok := DefaultTemplates[eventType]; !ok {
+			return nil, fmt.Errorf("unknown event %q", eventType)
+		}
+	}
+
+	target := &Target{
+		Name:           c.Name,
+		Emulators:      c.Emulators,
+		Events:         c.Events,
+		IncludePrivate: c.IncludePrivate,
+	}
+	if target.Name == "" {
+		target.Name = fmt.Sprintf("%s-%d", c.Type, index) // the name also keys the target's delivery queue
+	}
+	switch c.Type {
+	case "discord":
+		target.Notifier = &Discord{URL: url, PlainText: c.PlainText, Static: c.Static}
+	case "webhook":
+		target.Notifier = &Webhook{URL: url}
+	case "slack":
+		target.Notifier = &Slack{URL: url}
+	case "matrix":
+		target.Notifier = &Matrix{URL: url, Username: c.Username}
+	default:
+		return nil, fmt.Errorf("unknown type %q", c.Type)
+	}
+	for eventType, text := range c.Templates {
+		if err := target.SetTemplate(eventType, text); err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
@@ -0,0 +1,186 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var discordColors = map[string]int{
+	EventRoomCreated: 0x2ecc71,
+	EventGameStarted: 0x3498db,
+	EventGameEnded:   0x95a5a6,
+	EventDesync:      0xe74c3c,
+	EventServerStart: 0x2ecc71,
+	EventServerStop:  0xe67e22,
+}
+
+var eventTitles = map[string]string{
+	EventRoomCreated: "Room created",
+	EventGameStarted: "Game started",
+	EventGameEnded:   "Game ended",
+	EventDesync:      "Desync",
+	EventServerStart: "Server online",
+	EventServerStop:  "Server stopping",
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Timestamp   string         `json:"timestamp"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Color       int            `json:"color"`
+}
+
+// Discord posts to a Discord webhook as a rich embed, or as plain content like the original
+// announcements if PlainText is set. Room announcements are edited as the room changes and deleted
+// if it closes without playing, unless Static is set.
+type Discord struct {
+	URL       string
+	PlainText bool
+	Static    bool
+}
+
+func (n *Discord) Build(event *Event, message string) (*Delivery, error) {
+	if event.Type == EventRoomCreated && n.Live() {
+		// wait makes Discord answer with the message, whose ID is needed to edit it later
+		webhookURL, err := n.messageURL("", url.Values{"wait": {"true"}})
+		if err != nil {
+			return nil, err
+		}
+		return postJSON(webhookURL, n.body(event, message))
+	}
+	return postJSON(n.URL, n.body(event, message))
+}
+
+func (n *Discord) Live() bool {
+	return !n.Static
+}
+
+func (n *Discord) MessageID(response []byte) (string, error) {
+	var posted struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(response, &posted); err != nil {
+		return "", fmt.Errorf("could not parse Discord message: %s", err.Error())
+	}
+	if posted.ID == "" {
+		return "", fmt.Errorf("no message ID in Discord response")
+	}
+	return posted.ID, nil
+}
+
+func (n *Discord) BuildEdit(messageID string, event *Event, message string) (*Delivery, error) {
+	delivery, err := n.messageDelivery(http.MethodPatch, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if delivery.Body, err = json.Marshal(n.body(event, message)); err != nil {
+		return nil, fmt.Errorf("could not encode notification: %s", err.Error())
+	}
+	return delivery, nil
+}
+
+func (n *Discord) BuildDelete(messageID string) (*Delivery, error) {
+	return n.messageDelivery(http.MethodDelete, messageID)
+}
+
+func (n *Discord) messageDelivery(method string, messageID string) (*Delivery, error) {
+	messageURL, err := n.messageURL(messageID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Delivery{Method: method, URL: messageURL}, nil
+}
+
+// messageURL returns the webhook URL for the message with messageID, or the webhook itself if
+// messageID is empty, keeping parameters such as thread_id.
+func (n *Discord) messageURL(messageID string, query url.Values) (string, error) {
+	webhookURL, err := url.Parse(n.URL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse webhook URL") // the error would include the URL's secret
+	}
+	if messageID != "" {
+		webhookURL.Path = strings.TrimSuffix(webhookURL.Path, "/") + "/messages/" + url.PathEscape(messageID)
+	}
+	values := webhookURL.Query()
+	for key, value := range query {
+		values[key] = value
+	}
+	webhookURL.RawQuery = values.Encode()
+	return webhookURL.String(), nil
+}
+
+func (n *Discord) body(event *Event, message string) interface{} {
+	if n.PlainText {
+		return map[string]string{"content": message}
+	}
+	embed := discordEmbed{
+		Title:       eventTitles[event.Type],
+		Description: message,
+		Timestamp:   event.Time.UTC().Format(time.RFC3339),
+		Color:       discordColors[event.Type],
+	}
+	if event.Game != "" {
+		embed.Fields = append(embed.Fields, discordField{Name: "Game", Value: event.Game, Inline: true})
+	}
+	if event.Room != "" {
+		embed.Fields = append(embed.Fields, discordField{Name: "Room", Value: event.Room, Inline: true})
+	}
+	if len(event.Players) > 0 {
+		name := fmt.Sprintf("Players (%d/%d)", len(event.Players), MaxPlayers)
+		embed.Fields = append(embed.Fields, discordField{Name: name, Value: strings.Join(event.Players, ", ")})
+	}
+	if event.Duration > 0 {
+		embed.Fields = append(embed.Fields, discordField{Name: "Duration", Value: event.Duration.String(), Inline: true})
+	}
+	return map[string]interface{}{"embeds": []discordEmbed{embed}}
+}
+
+// Webhook posts the event itself with the rendered message, for services of our own.
+type Webhook struct {
+	URL string
+}
+
+func (n *Webhook) Build(event *Event, message string) (*Delivery, error) {
+	return postJSON(n.URL, map[string]interface{}{
+		"event":   event,
+		"message": message,
+	})
+}
+
+// Slack posts to a Slack compatible incoming webhook, which Mattermost and Rocket.Chat also accept.
+type Slack struct {
+	URL string
+}
+
+func (n *Slack) Build(_ *Event, message string) (*Delivery, error) {
+	return postJSON(n.URL, map[string]string{"text": message})
+}
+
+// Matrix posts to a Matrix webhook bridge such as matrix-hookshot, with an HTML version of the message.
+type Matrix struct {
+	URL      string
+	Username string
+}
+
+func (n *Matrix) Build(event *Event, message string) (*Delivery, error) {
+	body := map[string]string{
+		"text": message,
+		"html": fmt.Sprintf("<b>%s</b>: %s", html.EscapeString(eventTitles[event.Type]), html.EscapeString(message)),
+	}
+	if n.Username != "" {
+		body["username"] = n.Username
+	}
+	return postJSON(n.URL, body)
+}
@@ -0,0 +1,185 @@
+package notifier
+
+import (
+	"sync"
+	"time"
+)
+
+// Editor is a Notifier whose messages can be changed after they are posted, so a room's
+// announcement can follow the room instead of pointing people at a room that is full or gone.
+type Editor interface {
+	Notifier
+	// Live reports whether room announcements should be tracked at all.
+	Live() bool
+	// MessageID finds the posted message in the response to the announcement.
+	MessageID(response []byte) (string, error)
+	BuildEdit(messageID string, event *Event, message string) (*Delivery, error)
+	BuildDelete(messageID string) (*Delivery, error)
+}
+
+type liveKey struct {
+	target string
+	port   int
+}
+
+// liveMessage is a room announcement that is kept up to date. Only one request for the message
+// is in flight at a time, so edits cannot overtake each other or the post that creates it; changes
+// made meanwhile are collapsed into the newest one.
+type liveMessage struct {
+	target  *Target
+	editor  Editor
+	id      string
+	pending *Event // newest state not sent yet
+	mutex   sync.Mutex
+	busy    bool
+	posted  bool // false if the announcement never made it, so there is nothing to change
+	remove  bool
+}
+
+// next returns the request to send now, if any, and the event it is logged as.
+// The caller must hold the mutex.
+func (m *liveMessage) next(d *Dispatcher) (string, *Delivery) {
+	if m.busy || !m.posted {
+		return "", nil
+	}
+	var eventType string
+	var delivery *Delivery
+	var err error
+	switch {
+	case m.remove:
+		eventType = "delete"
+		delivery, err = m.editor.BuildDelete(m.id)
+		m.posted = false // nothing to do once it is deleted
+		m.pending = nil
+	case m.pending != nil:
+		eventType = m.pending.Type + " update"
+		var message string
+		if message, err = m.target.render(m.pending); err == nil {
+			delivery, err = m.editor.BuildEdit(m.id, m.pending, message)
+		}
+		m.pending = nil
+	default:
+		return "", nil
+	}
+	if err != nil {
+		d.Logger.Error(err, "could not build notification update", "target", m.target.Name)
+		return "", nil
+	}
+	m.busy = true
+	delivery.Done = func(_ []byte, _ error) { // a failed update is dead-lettered, the next one may still work
+		m.mutex.Lock()
+		m.busy = false
+		eventType, next := m.next(d)
+		m.mutex.Unlock()
+		d.send(m.target, eventType, next)
+	}
+	return eventType, delivery
+}
+
+// announced records the message ID once the announcement has been posted.
+func (m *liveMessage) announced(d *Dispatcher, response []byte, err error) {
+	m.mutex.Lock()
+	m.busy = false
+	if err != nil { // already dead-lettered by the queue
+		m.mutex.Unlock()
+		return
+	}
+	if m.id, err = m.editor.MessageID(response); err != nil {
+		m.mutex.Unlock()
+		d.Logger.Error(err, "could not track room announcement", "target", m.target.Name)
+		return
+	}
+	m.posted = true
+	eventType, next := m.next(d)
+	m.mutex.Unlock()
+	d.send(m.target, eventType, next)
+}
+
+func (m *liveMessage) update(d *Dispatcher, event *Event) {
+	m.mutex.Lock()
+	if m.remove {
+		m.mutex.Unlock()
+		return
+	}
+	m.pending = event
+	eventType, next := m.next(d)
+	m.mutex.Unlock()
+	d.send(m.target, eventType, next)
+}
+
+func (m *liveMessage) delete(d *Dispatcher) {
+	m.mutex.Lock()
+	m.remove = true
+	eventType, next := m.next(d)
+	m.mutex.Unlock()
+	d.send(m.target, eventType, next)
+}
+
+// liveEditor returns the target's Editor if it keeps its room announcements up to date.
+func (t *Target) liveEditor() (Editor, bool) {
+	editor, ok := t.Notifier.(Editor)
+	if !ok || !editor.Live() {
+		return nil, false
+	}
+	return editor, true
+}
+
+// announce posts a room announcement that will be kept up to date.
+func (d *Dispatcher) announce(target *Target, editor Editor, event *Event, delivery *Delivery) {
+	message := &liveMessage{target: target, editor: editor, busy: true}
+	delivery.Done = func(response []byte, err error) {
+		message.announced(d, response, err)
+	}
+	d.liveMutex.Lock()
+	if d.live == nil {
+		d.live = make(map[liveKey]*liveMessage)
+	}
+	d.live[liveKey{target: target.Name, port: event.Port}] = message
+	d.liveMutex.Unlock()
+	d.send(target, event.Type, delivery)
+}
+
+// liveMessage returns the kept up to date announcement of the room on port in target, if any.
+func (d *Dispatcher) liveMessage(target string, port int) *liveMessage {
+	d.liveMutex.Lock()
+	defer d.liveMutex.Unlock()
+	return d.live[liveKey{target: target, port: port}]
+}
+
+// liveMessages returns the kept up to date announcements of the room on port.
+func (d *Dispatcher) liveMessages(port int, forget bool) []*liveMessage {
+	d.liveMutex.Lock()
+	defer d.liveMutex.Unlock()
+	var messages []*liveMessage
+	for key, message := range d.live {
+		if key.port == port {
+			messages = append(messages, message)
+			if forget {
+				delete(d.live, key)
+			}
+		}
+	}
+	return messages
+}
+
+// UpdateRoom edits the announcements of a room that is still open, such as after a player joins
+// or leaves. event is rendered as an EventRoomCreated with the room's current details.
+func (d *Dispatcher) UpdateRoom(event Event) {
+	event.Type = EventRoomCreated
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, message := range d.liveMessages(event.Port, false) {
+		message.update(d, &event)
+	}
+}
+
+// CloseRoom stops following a room's announcements once the room is destroyed. A room that never
+// started has its announcements deleted, otherwise they stay as the last game event left them.
+func (d *Dispatcher) CloseRoom(port int, started bool) {
+	for _, message := range d.liveMessages(port, true) {
+		if !started {
+			message.delete(d)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Event types a target can subscribe to.
+const (
+	EventRoomCreated = "room_created"
+	EventGameStarted = "game_started"
+	EventGameEnded   = "game_ended"
+	EventDesync      = "desync"
+	EventServerStart = "server_start"
+	EventServerStop  = "server_stop"
+)
+
+const (
+	userAgent      = "simple64Bot (simple64.github.io, 1)"
+	legacyChannels = 10
+	MaxPlayers     = 4
+)
+
+// DefaultTemplates are used for events a target has no template for. They see the Event as data.
+var DefaultTemplates = map[string]string{
+	EventRoomCreated: "New {{if .Private}}private{{else}}public{{end}} netplay room running in {{.Server}} has been created! Come play {{.Game}} ({{len .Players}}/4 players)",
+	EventGameStarted: "{{.Room}} in {{.Server}} started playing {{.Game}} with {{len .Players}} players",
+	EventGameEnded:   "{{.Room}} in {{.Server}} finished playing {{.Game}} after {{.Duration}}",
+	EventDesync:      "{{.Room}} in {{.Server}} desynced playing {{.Game}} at VI {{.DesyncVI}}",
+	EventServerStart: "{{.Server}} is online",
+	EventServerStop:  "{{.Server}} is shutting down",
+}
+
+// Event is something that happened on the server. Room events carry the room's details,
+// server events only Type, Server and Time.
+type Event struct {
+	Time     time.Time     `json:"time"`
+	Type     string        `json:"type"`
+	Server   string        `json:"server"`
+	Emulator string        `json:"emulator,omitempty"`
+	Room     string        `json:"room,omitempty"`
+	Game     string        `json:"game,omitempty"`
+	Players  []string      `json:"players,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Port     int           `json:"port,omitempty"`
+	DesyncVI uint32        `json:"desync_vi,omitempty"`
+	Private  bool          `json:"private,omitempty"`
+}
+
+// Delivery is one HTTP request a notifier wants sent.
+type Delivery struct {
+	Done   func(response []byte, err error) // called once the delivery succeeded or was given up on, if set
+	Method string
+	URL    string
+	Body   []byte
+}
+
+// Notifier turns an event and its rendered message into the request its service expects.
+type Notifier interface {
+	Build(event *Event, message string) (*Delivery, error)
+}
+
+func postJSON(url string, body interface{}) (*Delivery, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode notification: %s", err.Error())
+	}
+	return &Delivery{Method: http.MethodPost, URL: url, Body: data}, nil
+}
+
+// Target is a notifier together with the events it wants to hear about.
+type Target struct {
+	Notifier       Notifier
+	Name           string   // used in logs, never the URL, which usually contains a secret
+	Emulators      []string // room events for other emulators are skipped, empty means all emulators
+	Events         []string // empty means every event
+	IncludePrivate bool     // also announce rooms with a password
+	templates      map[string]*template.Template
+}
+
+// SetTemplate overrides the message for one event type.
+func (t *Target) SetTemplate(eventType string, text string) error {
+	tmpl, err := template.New(eventType).Parse(text)
+	if err != nil {
+		return fmt.Errorf("could not parse %s template: %s", eventType, err.Error())
+	}
+	if t.templates == nil {
+		t.templates = make(map[string]*template.Template)
+	}
+	t.templates[eventType] = tmpl
+	return nil
+}
+
+func (t *Target) wants(event *Event) bool {
+	if event.Private && !t.IncludePrivate {
+		return false
+	}
+	if event.Emulator != "" && len(t.Emulators) > 0 && !containsFold(t.Emulators, event.Emulator) {
+		return false
+	}
+	return len(t.Events) == 0 || containsFold(t.Events, event.Type)
+}
+
+func (t *Target) build(event *Event) (*Delivery, error) {
+	message, err := t.render(event)
+	if err != nil {
+		return nil, err
+	}
+	return t.Notifier.Build(event, message)
+}
+
+func (t *Target) render(event *Event) (string, error) {
+	tmpl, ok := t.templates[event.Type]
+	if !ok {
+		tmpl, ok = defaultTemplates[event.Type]
+		if !ok {
+			return "", fmt.Errorf("no template for event %s", event.Type)
+		}
+	}
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, event); err != nil {
+		return "", fmt.Errorf("could not render %s message: %s", event.Type, err.Error())
+	}
+	return message.String(), nil
+}
+
+var defaultTemplates = func() map[string]*template.Template {
+	templates := make(map[string]*template.Template)
+	for eventType, text := range DefaultTemplates {
+		templates[eventType] = template.Must(template.New(eventType).Parse(text))
+	}
+	return templates
+}()
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatcher queues each event for the targets that want it, and keeps room announcements up to date.
+type Dispatcher struct {
+	Logger    logr.Logger
+	Targets   []*Target
+	Queue     *Queue
+	live      map[liveKey]*liveMessage
+	liveMutex sync.Mutex
+}
+
+func NewDispatcher(logger logr.Logger, targets []*Target, config QueueConfig) *Dispatcher {
+	return &Dispatcher{Logger: logger, Targets: targets, Queue: NewQueue(logger, config)}
+}
+
+// legacyTargets reads the Discord webhooks from <EMULATOR>_CHANNEL_<n>, which announce public
+// rooms, and <EMULATOR>_DEV_CHANNEL, which announces every room. Both only hear about new rooms.
+func legacyTargets(emulator string) []*Target {
+	if emulator == "" {
+		return nil
+	}
+	var targets []*Target
+	prefix := strings.ToUpper(emulator)
+	for i := 0; i < legacyChannels; i++ {
+		if url := os.Getenv(fmt.Sprintf("%s_CHANNEL_%d", prefix, i)); url != "" {
+			targets = append(targets, &Target{
+				Notifier: &Discord{URL: url, PlainText: true},
+				Name:     fmt.Sprintf("%s_CHANNEL_%d", prefix, i),
+				Events:   []string{EventRoomCreated},
+			})
+		}
+	}
+	if url := os.Getenv(fmt.Sprintf("%s_DEV_CHANNEL", prefix)); url != "" {
+		targets = append(targets, &Target{
+			Notifier:       &Discord{URL: url, PlainText: true},
+			Name:           fmt.Sprintf("%s_DEV_CHANNEL", prefix),
+			Events:         []string{EventRoomCreated},
+			IncludePrivate: true,
+		})
+	}
+	return targets
+}
+
+// Notify queues event for every configured target that wants it, and for the legacy environment
+// variable webhooks of its emulator. It does not wait for the deliveries.
+func (d *Dispatcher) Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	targets := append(append([]*Target(nil), d.Targets...), legacyTargets(event.Emulator)...)
+	for _, target := range targets {
+		if event.Type == EventGameStarted || event.Type == EventGameEnded {
+			// the room's announcement shows the game instead, whether or not the target wants the event
+			if message := d.liveMessage(target.Name, event.Port); message != nil {
+				message.update(d, &event)
+				continue
+			}
+		}
+		if !target.wants(&event) {
+			continue
+		}
+		delivery, err := target.build(&event)
+		if err != nil {
+			d.Logger.Error(err, "could not build notification", "target", target.Name, "event", event.Type)
+			continue
+		}
+		if editor, ok := target.liveEditor(); ok && event.Type == EventRoomCreated {
+			d.announce(target, editor, &event, delivery)
+			continue
+		}
+		d.send(target, event.Type, delivery)
+	}
+}
+
+func (d *Dispatcher) send(target *Target, eventType string, delivery *Delivery) {
+	if delivery != nil {
+		d.Queue.Enqueue(target.Name, eventType, delivery)
+	}
+}
+
+// Close waits up to timeout for queued notifications, such as EventServerStop, to be delivered.
+func (d *Dispatcher) Close(timeout time.Duration) {
+	if !d.Queue.Close(timeout) {
+		d.Logger.Info("gave up waiting for notifications", "metrics", d.Queue.Metrics())
+	}
+}
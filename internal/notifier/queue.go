@@ -0,0 +1,312 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	DefaultQueueSize   = 256
+	DefaultConcurrency = 2
+	DefaultMaxAttempts = 5
+	DefaultMinBackoff  = time.Second
+	DefaultMaxBackoff  = time.Minute
+	requestTimeout     = 10 * time.Second
+	maxResponseSize    = 1 << 20
+)
+
+// QueueConfig controls how notifications are delivered. Zero values use the defaults.
+type QueueConfig struct {
+	DeadLetterPath string // failed deliveries are appended here as JSON lines, if set
+	Size           int    // pending deliveries per target, more are dropped
+	Concurrency    int    // deliveries in flight per target
+	MaxAttempts    int
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (c *QueueConfig) setDefaults() {
+	if c.Size <= 0 {
+		c.Size = DefaultQueueSize
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = DefaultConcurrency
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultMaxAttempts
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = DefaultMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+}
+
+// QueueMetrics counts deliveries since the queue was created.
+type QueueMetrics struct {
+	Queued    uint64 `json:"queued"`
+	Delivered uint64 `json:"delivered"`
+	Retried   uint64 `json:"retried"`
+	Failed    uint64 `json:"failed"`  // gave up after an error, written to the dead-letter log
+	Dropped   uint64 `json:"dropped"` // the target's queue was full, also written to the dead-letter log
+	Pending   uint64 `json:"pending"`
+}
+
+type job struct {
+	delivery *Delivery
+	target   string
+	event    string
+}
+
+func (j *job) done(response []byte, err error) {
+	if j.delivery.Done != nil {
+		j.delivery.Done(response, err)
+	}
+}
+
+// deadLetter is one line of the dead-letter log. The URL is left out because webhook URLs
+// contain their secret, the target name says where the delivery was going.
+type deadLetter struct {
+	Time     time.Time       `json:"time"`
+	Target   string          `json:"target"`
+	Event    string          `json:"event"`
+	Method   string          `json:"method"`
+	Error    string          `json:"error"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+}
+
+// Queue delivers notifications in the background, so a slow webhook never holds up the lobby.
+// Each target gets its own bounded queue and workers, so one failing service does not delay the others.
+type Queue struct {
+	Logger    logr.Logger
+	config    QueueConfig
+	client    *http.Client
+	targets   map[string]chan *job
+	mutex     sync.Mutex
+	pending   sync.WaitGroup
+	deadMutex sync.Mutex
+	closed    bool
+	callbacks int // Done functions running in workers, their follow-ups are still taken once closed
+	queued    atomic.Uint64
+	delivered atomic.Uint64
+	retried   atomic.Uint64
+	failed    atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+func NewQueue(logger logr.Logger, config QueueConfig) *Queue {
+	config.setDefaults()
+	return &Queue{
+		Logger:  logger,
+		config:  config,
+		client:  &http.Client{Timeout: requestTimeout},
+		targets: make(map[string]chan *job),
+	}
+}
+
+// Enqueue schedules delivery to target. It never blocks: if the target's queue is full the
+// delivery is dropped and dead-lettered.
+func (q *Queue) Enqueue(target string, event string, delivery *Delivery) {
+	j := &job{delivery: delivery, target: target, event: event}
+	q.mutex.Lock()
+	if q.closed && q.callbacks == 0 {
+		q.mutex.Unlock()
+		q.dropped.Add(1)
+		err := fmt.Errorf("queue closed")
+		q.deadLetter(j, 0, err)
+		j.done(nil, err)
+		return
+	}
+	jobs, ok := q.targets[target]
+	if !ok {
+		jobs = make(chan *job, q.config.Size)
+		q.targets[target] = jobs
+		for i := 0; i < q.config.Concurrency; i++ {
+			go q.worker(jobs)
+		}
+	}
+	q.pending.Add(1)
+	select {
+	case jobs <- j:
+		q.queued.Add(1)
+		q.mutex.Unlock()
+	default:
+		q.pending.Done()
+		q.mutex.Unlock()
+		q.dropped.Add(1)
+		err := fmt.Errorf("queue full")
+		q.deadLetter(j, 0, err)
+		j.done(nil, err)
+	}
+}
+
+func (q *Queue) worker(jobs chan *job) {
+	for j := range jobs {
+		q.process(j)
+		q.pending.Done()
+	}
+}
+
+func (q *Queue) process(j *job) {
+	for attempt := 1; ; attempt++ {
+		response, retryAfter, retry, err := q.send(j.delivery)
+		if err == nil {
+			q.delivered.Add(1)
+			q.finish(j, response, nil)
+			return
+		}
+		if !retry || attempt >= q.config.MaxAttempts {
+			q.failed.Add(1)
+			q.deadLetter(j, attempt, err)
+			q.finish(j, response, err)
+			return
+		}
+		q.retried.Add(1)
+		time.Sleep(q.backoff(attempt, retryAfter))
+	}
+}
+
+// finish calls the job's Done function. Whatever it queues is let in even once the queue is closed,
+// because the job is still pending, so Close is still waiting and will wait for that too.
+func (q *Queue) finish(j *job, response []byte, err error) {
+	q.mutex.Lock()
+	q.callbacks++
+	q.mutex.Unlock()
+	j.done(response, err)
+	q.mutex.Lock()
+	q.callbacks--
+	q.mutex.Unlock()
+}
+
+// backoff doubles from MinBackoff on every attempt, waits at least as long as the service
+// asked with Retry-After, and never more than MaxBackoff.
+func (q *Queue) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	wait := q.config.MinBackoff
+	for i := 1; i < attempt && wait < q.config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	if wait > q.config.MaxBackoff {
+		wait = q.config.MaxBackoff
+	}
+	return wait
+}
+
+// send makes one attempt at a delivery and returns the response body. Network errors, 429 and
+// 5xx responses can be retried.
+func (q *Queue) send(delivery *Delivery) ([]byte, time.Duration, bool, error) {
+	var body io.Reader
+	if delivery.Body != nil {
+		body = bytes.NewReader(delivery.Body)
+	}
+	httpRequest, err := http.NewRequest(delivery.Method, delivery.URL, body)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("could not create request: %s", err.Error())
+	}
+	if body != nil {
+		httpRequest.Header.Set("Content-Type", "application/json")
+	}
+	httpRequest.Header.Set("User-Agent", userAgent)
+	resp, err := q.client.Do(httpRequest)
+	if err != nil {
+		return nil, 0, true, fmt.Errorf("could not send request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	_, _ = io.Copy(io.Discard, resp.Body) // lets the connection be reused
+
+	switch {
+	case resp.StatusCode < http.StatusMultipleChoices:
+		return response, 0, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		var retryAfter time.Duration
+		if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+			retryAfter = time.Duration(seconds * float64(time.Second))
+		}
+		return response, retryAfter, true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return response, 0, false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+func (q *Queue) deadLetter(j *job, attempts int, reason error) {
+	q.Logger.Error(reason, "could not deliver notification", "target", j.target, "event", j.event, "attempts", attempts)
+	if q.config.DeadLetterPath == "" {
+		return
+	}
+	entry := deadLetter{
+		Time:     time.Now(),
+		Target:   j.target,
+		Event:    j.event,
+		Method:   j.delivery.Method,
+		Error:    reason.Error(),
+		Body:     j.delivery.Body,
+		Attempts: attempts,
+	}
+	if !json.Valid(entry.Body) {
+		entry.Body = nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		q.Logger.Error(err, "could not encode dead letter")
+		return
+	}
+
+	q.deadMutex.Lock()
+	defer q.deadMutex.Unlock()
+	f, err := os.OpenFile(q.config.DeadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600) //nolint:gomnd,mnd
+	if err != nil {
+		q.Logger.Error(err, "could not open dead-letter log", "path", q.config.DeadLetterPath)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		q.Logger.Error(err, "could not write dead-letter log", "path", q.config.DeadLetterPath)
+	}
+}
+
+func (q *Queue) Metrics() QueueMetrics {
+	metrics := QueueMetrics{
+		Queued:    q.queued.Load(),
+		Delivered: q.delivered.Load(),
+		Retried:   q.retried.Load(),
+		Failed:    q.failed.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+	metrics.Pending = metrics.Queued - metrics.Delivered - metrics.Failed
+	return metrics
+}
+
+// Close stops accepting deliveries and waits up to timeout for the pending ones, including the
+// ones their Done functions queue, such as edits of an announcement that was still being posted.
+func (q *Queue) Close(timeout time.Duration) bool {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
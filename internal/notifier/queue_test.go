@@ -0,0 +1,194 @@
+package notifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// testServer answers the n-th request (from 1) with whatever respond writes, and records when each arrived.
+type testServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	arrivals []time.Time
+}
+
+func newTestServer(t *testing.T, respond func(n int, w http.ResponseWriter)) *testServer {
+	t.Helper()
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s.mutex.Lock()
+		s.arrivals = append(s.arrivals, time.Now())
+		n := len(s.arrivals)
+		s.mutex.Unlock()
+		respond(n, w)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) requests() []time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]time.Time(nil), s.arrivals...)
+}
+
+type result struct {
+	response []byte
+	err      error
+}
+
+// deliver queues a POST to url and returns a channel that gets the delivery's result.
+func deliver(q *Queue, url string) chan result {
+	results := make(chan result, 1)
+	q.Enqueue("test", "room created", &Delivery{
+		Method: http.MethodPost,
+		URL:    url,
+		Body:   []byte(`{"content":"hello"}`),
+		Done: func(response []byte, err error) {
+			results <- result{response: response, err: err}
+		},
+	})
+	return results
+}
+
+func wait(t *testing.T, results chan result) result {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery did not finish")
+		return result{}
+	}
+}
+
+func TestQueueRetriesServerErrors(t *testing.T) {
+	server := newTestServer(t, func(n int, w http.ResponseWriter) {
+		if n < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	q := NewQueue(logr.Discard(), QueueConfig{MinBackoff: 20 * time.Millisecond, MaxBackoff: time.Second})
+
+	r := wait(t, deliver(q, server.URL))
+	if r.err != nil || string(r.response) != "ok" {
+		t.Fatalf("got %q, %v, want the third response", r.response, r.err)
+	}
+	arrivals := server.requests()
+	if len(arrivals) != 3 {
+		t.Fatalf("got %d requests, want 3", len(arrivals))
+	}
+	// the backoff doubles: 20ms after the first failure, 40ms after the second
+	if gap := arrivals[1].Sub(arrivals[0]); gap < 20*time.Millisecond {
+		t.Fatalf("first retry after %s, want at least 20ms", gap)
+	}
+	if gap := arrivals[2].Sub(arrivals[1]); gap < 40*time.Millisecond {
+		t.Fatalf("second retry after %s, want at least 40ms", gap)
+	}
+	if metrics := q.Metrics(); metrics.Retried != 2 || metrics.Delivered != 1 || metrics.Failed != 0 {
+		t.Fatalf("got metrics %+v", metrics)
+	}
+}
+
+func TestQueueHonorsRetryAfter(t *testing.T) {
+	server := newTestServer(t, func(n int, w http.ResponseWriter) {
+		if n == 1 {
+			w.Header().Set("Retry-After", "0.1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	q := NewQueue(logr.Discard(), QueueConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Second})
+
+	if r := wait(t, deliver(q, server.URL)); r.err != nil {
+		t.Fatalf("unexpected error: %s", r.err.Error())
+	}
+	arrivals := server.requests()
+	if len(arrivals) != 2 {
+		t.Fatalf("got %d requests, want 2", len(arrivals))
+	}
+	if gap := arrivals[1].Sub(arrivals[0]); gap < 100*time.Millisecond {
+		t.Fatalf("retried after %s, want at least the 100ms asked for", gap)
+	}
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+	server := newTestServer(t, func(_ int, w http.ResponseWriter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	q := NewQueue(logr.Discard(), QueueConfig{DeadLetterPath: path, MaxAttempts: 2, MinBackoff: time.Millisecond})
+
+	if r := wait(t, deliver(q, server.URL)); r.err == nil {
+		t.Fatal("delivery succeeded against a failing webhook")
+	}
+	if len(server.requests()) != 2 {
+		t.Fatalf("got %d requests, want 2", len(server.requests()))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read dead-letter log: %s", err.Error())
+	}
+	var entry deadLetter
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("could not decode dead letter %q: %s", data, err.Error())
+	}
+	if entry.Target != "test" || entry.Event != "room created" || entry.Method != http.MethodPost || entry.Attempts != 2 || string(entry.Body) != `{"content":"hello"}` {
+		t.Fatalf("got dead letter %+v", entry)
+	}
+	if metrics := q.Metrics(); metrics.Failed != 1 || metrics.Pending != 0 {
+		t.Fatalf("got metrics %+v", metrics)
+	}
+}
+
+func TestQueueCloseDrains(t *testing.T) {
+	var delivered atomic.Int32
+	server := newTestServer(t, func(_ int, w http.ResponseWriter) {
+		time.Sleep(20 * time.Millisecond)
+		delivered.Add(1)
+	})
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	q := NewQueue(logr.Discard(), QueueConfig{DeadLetterPath: path, Concurrency: 1})
+
+	for i := 0; i < 3; i++ {
+		deliver(q, server.URL)
+	}
+	// a delivery whose Done queues another, the way announcement edits follow the announcement
+	q.Enqueue("test", "room created", &Delivery{
+		Method: http.MethodPost,
+		URL:    server.URL,
+		Done: func(_ []byte, _ error) {
+			deliver(q, server.URL)
+		},
+	})
+
+	if !q.Close(5 * time.Second) {
+		t.Fatal("Close gave up waiting")
+	}
+	if n := delivered.Load(); n != 5 {
+		t.Fatalf("%d deliveries were made before Close returned, want 5", n)
+	}
+
+	r := wait(t, deliver(q, server.URL))
+	if r.err == nil {
+		t.Fatal("a closed queue took a delivery")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the refused delivery was not dead-lettered: %s", err.Error())
+	}
+	if metrics := q.Metrics(); metrics.Delivered != 5 || metrics.Dropped != 1 || metrics.Pending != 0 {
+		t.Fatalf("got metrics %+v", metrics)
+	}
+}
@@ -4,16 +4,33 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-logr/zapr"
+	gameserver "github.com/simple64/mpn-server/internal/gameServer"
 	lobbyserver "github.com/simple64/mpn-server/internal/lobbyServer"
+	matchhistory "github.com/simple64/mpn-server/internal/matchHistory"
+	"github.com/simple64/mpn-server/internal/notifier"
 	"go.uber.org/zap"
 )
 
 const (
 	DefaultBasePort    = 45000
 	DefaultMOTDMessage = "MPN Beta"
+
+	DefaultMaxFileSize   = 16 * 1024 * 1024 // large enough for a savestate sent to a reconnecting player
+	DefaultMaxRoomBytes  = 64 * 1024 * 1024
+	DefaultMaxTotalBytes = 512 * 1024 * 1024
+	DefaultMaxRoomFiles  = 32
+
+	DefaultSaveVaultVersions  = 5
+	DefaultSaveVaultRetention = 90 * 24 * time.Hour
+
+	DefaultShutdownTimeout = 5 * time.Second // how long pending notifications get on shutdown
 )
 
 func newZap(logPath string) (*zap.Logger, error) {
@@ -25,14 +42,45 @@ func newZap(logPath string) (*zap.Logger, error) {
 	return cfg.Build() //nolint:wrapcheck
 }
 
+// newUploadBudget checks the upload limit flags and builds the budget shared by every room.
+func newUploadBudget(maxFileSize int64, maxRoomBytes int64, maxTotalBytes int64, maxRoomFiles int) (*gameserver.UploadBudget, error) {
+	// uploads are sized by 32-bit fields on the wire, so a larger per-file limit could never apply
+	if maxFileSize < 0 || maxFileSize > math.MaxUint32 {
+		return nil, fmt.Errorf("max-file-size must be between 0 and %d, got %d", uint32(math.MaxUint32), maxFileSize)
+	}
+	if maxRoomBytes < 0 || maxTotalBytes < 0 || maxRoomFiles < 0 {
+		return nil, fmt.Errorf("max-room-bytes, max-total-bytes and max-room-files must be 0 (unlimited) or more")
+	}
+	return &gameserver.UploadBudget{
+		MaxFileSize:   uint32(maxFileSize),
+		MaxRoomBytes:  maxRoomBytes,
+		MaxTotalBytes: maxTotalBytes,
+		MaxRoomFiles:  maxRoomFiles,
+	}, nil
+}
+
 func main() {
 	name := flag.String("name", "Localhost", "Server name")
 	basePort := flag.Int("baseport", DefaultBasePort, "Base port")
 	disableBroadcast := flag.Bool("disable-broadcast", false, "Disable LAN broadcast")
+	disableSTUN := flag.Bool("disable-stun", false, "Disable the STUN binding endpoint on the base port")
+	stunAltPort := flag.Int("stun-alt-port", 0, "Also answer STUN binding requests on this port, so clients can detect port-dependent NAT mapping")
 	logPath := flag.String("log-path", "", "Write logs to this file")
 	motd := flag.String("motd", "", "MOTD message to display to clients")
 	maxGames := flag.Int("max-games", 10, "Maximum number of concurrent games") //nolint:gomnd
 	enableAuth := flag.Bool("enable-auth", false, "Enable client authentication")
+	maxFileSize := flag.Int64("max-file-size", DefaultMaxFileSize, "Maximum size in bytes of a single save or custom data upload, at most 4294967295")
+	maxRoomBytes := flag.Int64("max-room-bytes", DefaultMaxRoomBytes, "Maximum bytes of uploads held by one room")
+	maxTotalBytes := flag.Int64("max-total-bytes", DefaultMaxTotalBytes, "Maximum bytes of uploads held by all rooms")
+	maxRoomFiles := flag.Int("max-room-files", DefaultMaxRoomFiles, "Maximum number of uploads held by one room")
+	saveVaultDir := flag.String("save-vault-dir", "", "Keep uploaded saves in this directory for rooms that set a save group")
+	saveVaultVersions := flag.Int("save-vault-versions", DefaultSaveVaultVersions, "Number of versions of each save kept in the save vault")
+	saveVaultRetention := flag.Duration("save-vault-retention", DefaultSaveVaultRetention, "Remove save vault versions older than this")
+	historyPath := flag.String("history-db", "", "Record finished games in this database file and serve them on /history")
+	notifyConfig := flag.String("notify-config", "", "JSON file with the webhooks to notify about rooms, games and the server")
+	notifyQueueSize := flag.Int("notify-queue-size", notifier.DefaultQueueSize, "Maximum pending notifications per webhook, more are dropped")
+	notifyConcurrency := flag.Int("notify-concurrency", notifier.DefaultConcurrency, "Notifications sent at the same time per webhook")
+	notifyDeadLetter := flag.String("notify-dead-letter", "", "Append notifications that could not be delivered to this file")
 	flag.Parse()
 
 	zapLog, err := newZap(*logPath)
@@ -46,6 +94,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	uploadBudget, err := newUploadBudget(*maxFileSize, *maxRoomBytes, *maxTotalBytes, *maxRoomFiles)
+	if err != nil {
+		logger.Error(err, "invalid upload limits")
+		os.Exit(1)
+	}
+
 	fmt.Println("successfully finished startup")
 
 	if *motd == "" {
@@ -60,7 +114,53 @@ func main() {
 		Motd:             *motd,
 		MaxGames:         *maxGames,
 		EnableAuth:       *enableAuth,
+		DisableSTUN:      *disableSTUN,
+		STUNAltPort:      *stunAltPort,
+		UploadBudget:     uploadBudget,
+	}
+	if *saveVaultDir != "" {
+		s.SaveVault = &gameserver.SaveVault{
+			Dir:         *saveVaultDir,
+			MaxFileSize: int64(uploadBudget.MaxFileSize),
+			MaxVersions: *saveVaultVersions,
+			Retention:   *saveVaultRetention,
+		}
 	}
+	if *historyPath != "" {
+		history, err := matchhistory.Open(*historyPath)
+		if err != nil {
+			logger.Error(err, "could not open match history", "path", *historyPath)
+			os.Exit(1)
+		}
+		defer history.Close()
+		s.History = history
+	}
+	var targets []*notifier.Target
+	if *notifyConfig != "" {
+		targets, err = notifier.LoadConfig(*notifyConfig)
+		if err != nil {
+			logger.Error(err, "could not load notification config", "path", *notifyConfig)
+			os.Exit(1)
+		}
+	}
+	s.Notifier = notifier.NewDispatcher(logger, targets, notifier.QueueConfig{
+		DeadLetterPath: *notifyDeadLetter,
+		Size:           *notifyQueueSize,
+		Concurrency:    *notifyConcurrency,
+	})
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		s.NotifyServerStop()
+		s.Notifier.Close(DefaultShutdownTimeout)
+		if s.History != nil {
+			s.History.Close()
+		}
+		os.Exit(0)
+	}()
+
 	go s.LogServerStats()
 	if err := s.RunSocketServer(DefaultBasePort); err != nil {
 		logger.Error(err, "could not run socket server")